@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"math"
@@ -12,7 +13,6 @@ import (
 	"github.com/gonum/plot/plotter"
 	"github.com/gonum/plot/plotutil"
 	"github.com/gonum/plot/vg"
-	"github.com/kshedden/dimred"
 	"github.com/kshedden/dstream/dstream"
 )
 
@@ -22,6 +22,12 @@ const (
 	minCount    int = 100
 	nrow        int = 100
 	ncol        int = 100
+
+	// checkpointFile holds the serialized DOCState, rewritten after
+	// every dstream chunk processed during the fit, so that a later
+	// run with --resume can pick up from the last completed chunk
+	// instead of restarting the fit from scratch.
+	checkpointFile string = "doc_state.txt"
 )
 
 // selectEq returns a function that can be used with Filter to retain
@@ -141,37 +147,6 @@ func standardize(vec, mat []float64) {
 	floats.Scale(1/v, vec)
 }
 
-// getBrakeProb estimates the probability of breaking at each value of
-// a numeric score.  The breaking probabilities are estimated based on
-// a local mean (+/- w positions from the score value being
-// conditioned on).
-func getBrakeProb(sc, br []float64, w int) ([]float64, []float64) {
-
-	ii := make([]int, len(sc))
-	floats.Argsort(sc, ii)
-
-	// Reorder br to be compatible with sc.
-	var b []float64
-	for _, i := range ii {
-		b = append(b, br[i])
-	}
-
-	z := make([]float64, len(sc))
-	for i := w; i < len(b)-w; i++ {
-		if b[i] == 1 {
-			for j := i - w; j < i+w; j++ {
-				z[j]++
-			}
-		}
-	}
-
-	for i, _ := range z {
-		z[i] /= float64(2 * w)
-	}
-
-	return sc[w : len(sc)-w], z[w : len(z)-w]
-}
-
 func getPos(data dstream.Dstream, name string) int {
 	for k, v := range data.Names() {
 		if v == name {
@@ -181,132 +156,6 @@ func getPos(data dstream.Dstream, name string) int {
 	panic("cannot find " + name)
 }
 
-func cellMeans(data dstream.Dstream, row, col []int) ([][]float64, []int) {
-
-	var il []int
-	for k := 0; k <= maxSpeedLag; k++ {
-		il = append(il, getPos(data, fmt.Sprintf("Speed[%d]", -k)))
-	}
-	for k := 0; k <= maxRangeLag; k++ {
-		il = append(il, getPos(data, fmt.Sprintf("FcwRange[%d]", -k)))
-	}
-
-	cmn := make([][]float64, nrow*ncol)
-	cmc := make([]int, nrow*ncol)
-	for i := 0; i < nrow*ncol; i++ {
-		cmn[i] = make([]float64, len(il))
-	}
-
-	data.Reset()
-	ii := 0
-	for data.Next() {
-		var n int
-		for j, k := range il {
-			v := data.GetPos(k).([]float64)
-			n = len(v)
-			for i := 0; i < len(v); i++ {
-				jj := ii + i
-				if row[jj] >= 0 && row[jj] < nrow && col[jj] >= 0 && col[jj] < ncol {
-					q := row[jj]*ncol + col[jj]
-					cmn[q][j] += v[i]
-					if j == 0 {
-						cmc[q]++
-					}
-				}
-			}
-		}
-		ii += n
-	}
-
-	for q, v := range cmn {
-		floats.Scale(1/float64(cmc[q]), v)
-	}
-
-	return cmn, cmc
-}
-
-func standardizeCellMeans(cmn [][]float64, cmc []int) {
-
-	v := make([]float64, len(cmn[0]))
-
-	// Center
-	w := 0
-	for i, u := range cmn {
-		if cmc[i] > 0 {
-			floats.AddScaled(v, float64(cmc[i]), u)
-			w += cmc[i]
-		}
-	}
-	floats.Scale(1/float64(w), v)
-	for _, u := range cmn {
-		floats.Sub(u, v)
-	}
-
-	// Scale
-	for j, _ := range v {
-		v[j] = 0
-	}
-	w = 0
-	for i, u := range cmn {
-		if cmc[i] > 0 {
-			for j, _ := range u {
-				v[j] += float64(cmc[i]) * u[j] * u[j]
-			}
-			w += cmc[i]
-		}
-	}
-	floats.Scale(1/float64(w), v)
-	for j, x := range v {
-		v[j] = math.Sqrt(x)
-	}
-	for i, u := range cmn {
-		for j, x := range u {
-			cmn[i][j] = x / v[j]
-		}
-	}
-}
-
-func heatMap(row, col []int, y, x0, x1 []float64) ([]float64, []int) {
-	missed := 0
-	hit := 0
-	num := make([]float64, nrow*ncol)
-	denom := make([]int, nrow*ncol)
-	for i, _ := range x0 {
-		if row[i] >= 0 && col[i] >= 0 && row[i] < nrow && col[i] < ncol {
-			denom[ncol*row[i]+col[i]]++
-			if y[i] == 1 {
-				num[ncol*row[i]+col[i]]++
-			}
-			hit++
-		} else {
-			missed++
-		}
-	}
-	fmt.Printf("Missed %d\n", missed)
-	fmt.Printf("Hit %d\n", hit)
-
-	rat := make([]float64, nrow*ncol)
-	for i, _ := range num {
-		if denom[i] > minCount {
-			rat[i] = math.Pow(num[i]/float64(denom[i]), 0.1)
-		} else {
-			rat[i] = -1
-		}
-	}
-
-	return rat, denom
-}
-
-func getCells(x0, x1 []float64) ([]int, []int) {
-	row := make([]int, len(x0))
-	col := make([]int, len(x1))
-	for i, _ := range x0 {
-		row[i] = int(math.Floor(70*x0[i] + 50))
-		col[i] = int(math.Floor(15*x1[i] + 50))
-	}
-	return row, col
-}
-
 // Generate a heatmap of a m x m covariance matrix, converting it to a
 // correlation matrix if scale is true.
 func plotcov(cov []float64, scale bool, m int, pc plotconfig, fname string) {
@@ -384,7 +233,10 @@ func plotlines(x [][]float64, scale bool, names []string, pc plotconfig, fname s
 	}
 }
 
-func plotscatter(x []float64, y []float64, pc plotconfig, fname string) {
+// plotscatter draws a scatter plot of y against x.  If se is
+// non-nil, a shaded +/- 2 SE ribbon is drawn behind the points using
+// se[i] as the standard error of y[i].
+func plotscatter(x []float64, y []float64, se []float64, pc plotconfig, fname string) {
 
 	z := make(plotter.XYs, len(x))
 	for i := range x {
@@ -397,6 +249,28 @@ func plotscatter(x []float64, y []float64, pc plotconfig, fname string) {
 		panic(err)
 	}
 
+	if se != nil {
+		lo := make([]float64, len(y))
+		hi := make([]float64, len(y))
+		for i := range y {
+			lo[i] = y[i] - 2*se[i]
+			hi[i] = y[i] + 2*se[i]
+		}
+		poly := make(plotter.XYs, 0, 2*len(x))
+		for i := range x {
+			poly = append(poly, plotter.XY{X: x[i], Y: hi[i]})
+		}
+		for i := len(x) - 1; i >= 0; i-- {
+			poly = append(poly, plotter.XY{X: x[i], Y: lo[i]})
+		}
+		ribbon, err := plotter.NewPolygon(poly)
+		if err != nil {
+			panic(err)
+		}
+		ribbon.Color = bandColor(0)
+		p.Add(ribbon)
+	}
+
 	s, err := plotter.NewScatter(z)
 	if err != nil {
 		panic(err)
@@ -439,8 +313,26 @@ func (h *covheat) Y(r int) float64 {
 	return float64(h.m) - float64(r)
 }
 
+// docFit is satisfied by DOCState (the DOC fit, checkpointed and
+// resumable) as well as SIR and SAVE, so the plotting code below does
+// not need to care which backend produced the fitted directions.
+type docFit interface {
+	YMean(k int) []float64
+	YCov(k int) []float64
+	MeanDir() []float64
+	CovDir(k int) []float64
+}
+
 func main() {
 
+	resume := flag.Bool("resume", false, "resume the fit from "+checkpointFile+" if it exists")
+	boot := flag.Bool("boot", false, "compute bootstrap confidence bands for the fitted directions")
+	nboot := flag.Int("nboot", 200, "number of bootstrap resamples, used with --boot")
+	export := flag.String("export", "", "if set, write the fitted DOC outputs as tab-separated tables to this directory")
+	heatmap := flag.Bool("heatmap", false, "plot a P(Brake) heat map and contour over the dr0/dr1 scores")
+	method := flag.String("method", "doc", "dimension reduction backend to fit: doc, sir, or save")
+	flag.Parse()
+
 	rdr, err := os.Open("/nfs/turbo/ivbss/LvFot/data_001.txt")
 	if err != nil {
 		panic(err)
@@ -464,45 +356,118 @@ func main() {
 	ivb = dstream.Filter(ivb, map[string]dstream.FilterFunc{"brake2": selectEq(0),
 		"FcwValidTarget": selectEq(1), "Speed[0]": selectGt(7)})
 
+	// Keep a reference to the pre-drop stream (still carrying
+	// Trip) around for the bootstrap, which resamples whole trips.
+	ivbTrip := ivb
+
 	ivb = dstream.DropCols(ivb, []string{"Trip", "Time", "Time$d1", "FcwValidTarget", "brake2"})
 	ivb = dstream.MemCopy(ivb)
 
 	ivr := dstream.NewReg(ivb, "Brake", nil, "", "")
 
-	doc := dimred.NewDOC(ivr)
-	doc.SetLogFile("log.txt")
-	doc.Init()
-
 	ndir := 2
-	doc.Fit(ndir)
+	var fit docFit
+	var bootstrapSource *DOCState
+
+	smoothOpts := SmoothOptions{Kernel: Gaussian, Method: LocalLinear}
+
+	switch *method {
+	case "sir":
+		reducer := NewSIR(ivb, ivr.XNames(), "Brake", 2)
+		reducer.Init()
+		reducer.Fit(ndir)
+		fit = reducer
+	case "save":
+		reducer := NewSAVE(ivb, ivr.XNames(), "Brake", 2)
+		reducer.Init()
+		reducer.Fit(ndir)
+		fit = reducer
+	default:
+		var resumeFrom *DOCState
+		if *resume {
+			if st, err := LoadDOCState(checkpointFile); err == nil {
+				log.Printf("resuming from %s (chunks done=%d, nobs=%d)", checkpointFile, st.ChunksDone, st.NObs)
+				resumeFrom = st
+			} else {
+				log.Printf("could not load %s (%v), fitting from scratch", checkpointFile, err)
+			}
+		}
+		st, err := AccumulateDOCState(ivb, "Brake", ivr.XNames(), ndir, checkpointFile, resumeFrom)
+		if err != nil {
+			log.Panic(err)
+		}
+		fit = st
+		bootstrapSource = st
+	}
+
+	if *boot {
+		if bootstrapSource == nil {
+			log.Printf("--boot requires the doc method, ignoring")
+		} else {
+			bres := BootstrapDOC(ivbTrip, "Trip", ivr.XNames(), bootstrapSource, ndir, *nboot, 1)
+
+			z := [][]float64{fit.MeanDir()[0:31], fit.MeanDir()[31:62]}
+			band := [][3][]float64{
+				{bres.MeanDirBand[0][0:31], bres.MeanDirBand[1][0:31], bres.MeanDirBand[2][0:31]},
+				{bres.MeanDirBand[0][31:62], bres.MeanDirBand[1][31:62], bres.MeanDirBand[2][31:62]},
+			}
+			if err := plotlinesBand(z, band, []string{"Speed", "Range"}, plotconfig{xlabel: "Time lag", ylabel: "Coefficient"}, "mean_dir_boot.pdf"); err != nil {
+				log.Printf("bootstrap plot failed: %v", err)
+			}
+
+			z = [][]float64{fit.CovDir(0)[0:31], fit.CovDir(1)[0:31]}
+			band = [][3][]float64{
+				{bres.CovDirBand[0][0][0:31], bres.CovDirBand[0][1][0:31], bres.CovDirBand[0][2][0:31]},
+				{bres.CovDirBand[1][0][0:31], bres.CovDirBand[1][1][0:31], bres.CovDirBand[1][2][0:31]},
+			}
+			if err := plotlinesBand(z, band, []string{"Cov1", "Cov2"}, plotconfig{xlabel: "Time lag", ylabel: "Speed"}, "speed_dir_boot.pdf"); err != nil {
+				log.Printf("bootstrap plot failed: %v", err)
+			}
+
+			z = [][]float64{fit.CovDir(0)[31:62], fit.CovDir(1)[31:62]}
+			band = [][3][]float64{
+				{bres.CovDirBand[0][0][31:62], bres.CovDirBand[0][1][31:62], bres.CovDirBand[0][2][31:62]},
+				{bres.CovDirBand[1][0][31:62], bres.CovDirBand[1][1][31:62], bres.CovDirBand[1][2][31:62]},
+			}
+			if err := plotlinesBand(z, band, []string{"Cov1", "Cov2"}, plotconfig{xlabel: "Time lag", ylabel: "Range"}, "range_dir_boot.pdf"); err != nil {
+				log.Printf("bootstrap plot failed: %v", err)
+			}
+
+			meanDirFn := func(d *DOCState) []float64 { return d.MeanDir() }
+			grid, lo, mid, hi := BootstrapBrakeProb(ivbTrip, "Trip", ivr.XNames(), fit.MeanDir(), meanDirFn, ndir, 40, *nboot, 2, smoothOpts)
+			if err := plotscatterBand(grid, mid, lo, hi, plotconfig{xlabel: "Mean direction", ylabel: "P(Brake)"}, "dr0_boot.png"); err != nil {
+				log.Printf("bootstrap plot failed: %v", err)
+			}
+		}
+	}
 
 	fmt.Printf("nobs after fit=%d\n", ivb.NumObs())
 	fmt.Printf("%v\n", ivr.XNames()[0:31])
 	fmt.Printf("%v\n", ivr.XNames()[31:62])
 
-	fmt.Printf("%d %d %d\n", len(doc.YMean(0)), len(doc.MeanDir()), len(doc.CovDir(0)))
+	fmt.Printf("%d %d %d\n", len(fit.YMean(0)), len(fit.MeanDir()), len(fit.CovDir(0)))
 
-	z := [][]float64{doc.YMean(0)[0:31], doc.YMean(1)[0:31]}
+	z := [][]float64{fit.YMean(0)[0:31], fit.YMean(1)[0:31]}
 	plotlines(z, false, []string{"0", "1"}, plotconfig{title: "Mean speed", xlabel: "Time lag", ylabel: "Speed"}, "meanspeed.pdf")
-	z = [][]float64{doc.YMean(0)[31:62], doc.YMean(1)[31:62]}
+	z = [][]float64{fit.YMean(0)[31:62], fit.YMean(1)[31:62]}
 	plotlines(z, false, []string{"0", "1"}, plotconfig{title: "Mean range", xlabel: "Time lag", ylabel: "Range"}, "meanrange.pdf")
 
-	plotcov(doc.YCov(0), true, 62, plotconfig{title: "Non-braking correlation", xlabel: "Time lag", ylabel: "Time lag"}, "cov0.pdf")
-	plotcov(doc.YCov(1), true, 62, plotconfig{title: "Braking correlation", xlabel: "Time lag", ylabel: "Time lag"}, "cov1.pdf")
+	plotcov(fit.YCov(0), true, 62, plotconfig{title: "Non-braking correlation", xlabel: "Time lag", ylabel: "Time lag"}, "cov0.pdf")
+	plotcov(fit.YCov(1), true, 62, plotconfig{title: "Braking correlation", xlabel: "Time lag", ylabel: "Time lag"}, "cov1.pdf")
 
 	covdiff := make([]float64, 62*62)
-	floats.SubTo(covdiff, doc.YCov(1), doc.YCov(0))
+	floats.SubTo(covdiff, fit.YCov(1), fit.YCov(0))
 	plotcov(covdiff, false, 62, plotconfig{title: "Covariance difference", xlabel: "Time lag", ylabel: "Time lag"}, "covdiff.pdf")
 
-	z = [][]float64{doc.MeanDir()[0:31], doc.MeanDir()[31:62]}
+	z = [][]float64{fit.MeanDir()[0:31], fit.MeanDir()[31:62]}
 	plotlines(z, true, []string{"Speed", "Range"}, plotconfig{xlabel: "Time lag", ylabel: "Coefficient"}, "mean_dir.pdf")
 
-	z = [][]float64{doc.CovDir(0)[0:31], doc.CovDir(1)[0:31]}
+	z = [][]float64{fit.CovDir(0)[0:31], fit.CovDir(1)[0:31]}
 	plotlines(z, true, []string{"Cov1", "Cov2"}, plotconfig{xlabel: "Time lag", ylabel: "Speed"}, "speed_dir.pdf")
-	z = [][]float64{doc.CovDir(0)[31:62], doc.CovDir(1)[31:62]}
+	z = [][]float64{fit.CovDir(0)[31:62], fit.CovDir(1)[31:62]}
 	plotlines(z, true, []string{"Cov1", "Cov2"}, plotconfig{xlabel: "Time lag", ylabel: "Range"}, "range_dir.pdf")
 
-	dirs0 := [][]float64{doc.MeanDir(), doc.CovDir(0), doc.CovDir(1)}
+	dirs0 := [][]float64{fit.MeanDir(), fit.CovDir(0), fit.CovDir(1)}
 
 	// Expand to match the data set
 	vm := make(map[string]int)
@@ -519,25 +484,50 @@ func main() {
 	}
 	ivb = dstream.Linapply(ivb, dirs, "dr")
 
-	ww := 3000
+	if *export != "" {
+		if err := WriteDOCTables(fit, ivb, ivr.XNames(), ndir, *export); err != nil {
+			log.Printf("failed to write DOC tables: %v", err)
+		}
+	}
+
+	if *heatmap {
+		ivb.Reset()
+		hx0 := dstream.GetCol(ivb, "dr0").([]float64)
+		ivb.Reset()
+		hx1 := dstream.GetCol(ivb, "dr1").([]float64)
+		ivb.Reset()
+		hy := dstream.GetCol(ivb, "Brake").([]float64)
+
+		grid := NewAdaptiveGrid(hx0, hx1, nrow, ncol, EqualFrequency)
+		rat, _ := grid.HeatMap(hy, hx0, hx1)
+
+		if err := grid.PlotHeatMap(rat, plotconfig{title: "P(Brake)", xlabel: "dr1", ylabel: "dr0"}, "heatmap.png"); err != nil {
+			log.Printf("heatmap plot failed: %v", err)
+		}
+		levels := []float64{0.2, 0.4, 0.6, 0.8}
+		if err := grid.PlotContour(rat, levels, plotconfig{title: "P(Brake)", xlabel: "dr1", ylabel: "dr0"}, "contour.png"); err != nil {
+			log.Printf("contour plot failed: %v", err)
+		}
+	}
+
 	ivb.Reset()
 	ux := dstream.GetCol(ivb, "dr0").([]float64)
 	ivb.Reset()
 	uy := dstream.GetCol(ivb, "Brake").([]float64)
-	x0, b0 := getBrakeProb(ux, uy, ww)
-	plotscatter(x0, b0, plotconfig{xlabel: "Mean direction", ylabel: "P(Brake)"}, "dr0.png")
+	x0, b0, se0 := SmoothBrakeProb(ux, uy, smoothOpts)
+	plotscatter(x0, b0, se0, plotconfig{xlabel: "Mean direction", ylabel: "P(Brake)"}, "dr0.png")
 
 	ivb.Reset()
 	ux = dstream.GetCol(ivb, "dr1").([]float64)
 	ivb.Reset()
 	uy = dstream.GetCol(ivb, "Brake").([]float64)
-	x0, b0 = getBrakeProb(ux, uy, ww)
-	plotscatter(x0, b0, plotconfig{xlabel: "Covariance direction 1", ylabel: "P(Brake)"}, "dr1.png")
+	x0, b0, se0 = SmoothBrakeProb(ux, uy, smoothOpts)
+	plotscatter(x0, b0, se0, plotconfig{xlabel: "Covariance direction 1", ylabel: "P(Brake)"}, "dr1.png")
 
 	ivb.Reset()
 	ux = dstream.GetCol(ivb, "dr2").([]float64)
 	ivb.Reset()
 	uy = dstream.GetCol(ivb, "Brake").([]float64)
-	x0, b0 = getBrakeProb(ux, uy, ww)
-	plotscatter(x0, b0, plotconfig{xlabel: "Covariance direction 1", ylabel: "P(Brake)"}, "dr2.png")
+	x0, b0, se0 = SmoothBrakeProb(ux, uy, smoothOpts)
+	plotscatter(x0, b0, se0, plotconfig{xlabel: "Covariance direction 2", ylabel: "P(Brake)"}, "dr2.png")
 }
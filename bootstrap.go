@@ -0,0 +1,530 @@
+package main
+
+import (
+	"image/color"
+	"math"
+	"math/rand"
+	"sort"
+
+	"github.com/gonum/floats"
+	"github.com/gonum/matrix/mat64"
+	"github.com/gonum/plot"
+	"github.com/gonum/plot/plotter"
+	"github.com/gonum/plot/vg"
+	"github.com/kshedden/dstream/dstream"
+)
+
+// bandPalette gives each curve index a solid line color and a
+// matching, partly-transparent fill color for its percentile ribbon.
+var bandPalette = []color.RGBA{
+	{R: 0xd6, G: 0x27, B: 0x28, A: 0xff},
+	{R: 0x1f, G: 0x77, B: 0xb4, A: 0xff},
+	{R: 0x2c, G: 0xa0, B: 0x2c, A: 0xff},
+}
+
+func lineColor(i int) color.Color {
+	return bandPalette[i%len(bandPalette)]
+}
+
+func bandColor(i int) color.Color {
+	c := bandPalette[i%len(bandPalette)]
+	c.A = 0x40
+	return c
+}
+
+func newPlot(pc plotconfig) (*plot.Plot, error) {
+	p, err := plot.New()
+	if err != nil {
+		return nil, err
+	}
+	p.Title.Text = pc.title
+	p.X.Label.Text = pc.xlabel
+	p.Y.Label.Text = pc.ylabel
+	return p, nil
+}
+
+func savePlot(p *plot.Plot, fname string) error {
+	return p.Save(4*vg.Inch, 4*vg.Inch, fname)
+}
+
+// BootstrapResult holds the bootstrap replicates and pointwise
+// percentile bands for the outputs of a DOC fit.
+type BootstrapResult struct {
+	MeanDir [][]float64   // nboot x p, sign-aligned to the point estimate
+	CovDir  [][][]float64 // ndir x nboot x p, sign-aligned to the point estimate
+
+	MeanDirBand [3][]float64   // 2.5/50/97.5 percentile bands for MeanDir
+	CovDirBand  [][3][]float64 // per-direction percentile bands for CovDir
+}
+
+// tripWeights assigns each distinct value of tripVar an iid Poisson(1)
+// replicate multiplicity, giving a Poisson (Bayesian-style) bootstrap
+// over trips: a trip with weight 0 is excluded from the replicate, and
+// a trip with weight w>=1 contributes w copies of itself.  Folding the
+// weight into DOCState.Add (or, for a raw score/response curve,
+// physically duplicating the trip's rows w times) reproduces the
+// sampling variance of an ordinary with-replacement bootstrap, which a
+// 0/1 inclusion mask alone would understate.
+func tripWeights(trips []float64, rng *rand.Rand) map[float64]int {
+	weight := make(map[float64]int)
+	for _, t := range trips {
+		if _, ok := weight[t]; !ok {
+			weight[t] = poisson(rng, 1)
+		}
+	}
+	return weight
+}
+
+// poisson draws a Poisson(lambda) random variate using Knuth's
+// product-of-uniforms method, which is adequate for the small lambda
+// (=1) used by tripWeights.
+func poisson(rng *rand.Rand, lambda float64) int {
+	l := math.Exp(-lambda)
+	p := 1.0
+	k := 0
+	for {
+		p *= rng.Float64()
+		if p <= l {
+			return k
+		}
+		k++
+	}
+}
+
+func uniqueTrips(ivb dstream.Dstream, tripVar string) []float64 {
+	ivb.Reset()
+	pos := getPos(ivb, tripVar)
+	seen := make(map[float64]bool)
+	var trips []float64
+	for ivb.Next() {
+		v := ivb.GetPos(pos).([]float64)
+		for _, t := range v {
+			if !seen[t] {
+				seen[t] = true
+				trips = append(trips, t)
+			}
+		}
+	}
+	return trips
+}
+
+// fitReplicate refits a DOC model on the resample of ivb described by
+// weight (a per-trip replicate multiplicity produced by tripWeights),
+// accumulating the same per-class sufficient statistics as
+// AccumulateDOCState so that the replicate is produced by the same
+// checkpointable DOCState engine as the point estimate.  A trip with
+// weight w contributes w times its ordinary moment contribution,
+// which is what makes this a real with-replacement bootstrap rather
+// than a 0/1 subsample.
+func fitReplicate(ivb dstream.Dstream, tripVar string, xnames []string, respvar string, weight map[float64]int, ndir int) *DOCState {
+
+	tripPos := getPos(ivb, tripVar)
+	xpos := make([]int, len(xnames))
+	for i, nm := range xnames {
+		xpos[i] = getPos(ivb, nm)
+	}
+	ypos := getPos(ivb, respvar)
+
+	st := NewDOCState(xnames, ndir)
+
+	ivb.Reset()
+	x := make([]float64, len(xnames))
+	for ivb.Next() {
+		trip := ivb.GetPos(tripPos).([]float64)
+		cols := make([][]float64, len(xpos))
+		for j, p := range xpos {
+			cols[j] = ivb.GetPos(p).([]float64)
+		}
+		yv := ivb.GetPos(ypos).([]float64)
+
+		for i := range yv {
+			w := weight[trip[i]]
+			if w == 0 {
+				continue
+			}
+			for j, c := range cols {
+				x[j] = c[i]
+			}
+			k := 0
+			if yv[i] == 1 {
+				k = 1
+			}
+			st.Add(k, x, float64(w))
+		}
+		st.NObs += len(yv)
+	}
+	st.finalize(ndir)
+
+	return st
+}
+
+// BootstrapDOC runs a block (Poisson) bootstrap over trips, refitting a
+// DOCState on nboot resamples of ivb and aligning each replicate's
+// direction vectors to the point estimate doc by sign flipping to
+// maximize inner product.  ivb must still carry tripVar (call this
+// before any DropCols step removes it).
+func BootstrapDOC(ivb dstream.Dstream, tripVar string, xnames []string, doc *DOCState, ndir, nboot int, seed int64) *BootstrapResult {
+
+	rng := rand.New(rand.NewSource(seed))
+	trips := uniqueTrips(ivb, tripVar)
+
+	res := &BootstrapResult{
+		CovDir: make([][][]float64, ndir),
+	}
+
+	refMean := doc.MeanDir()
+	refCov := make([][]float64, ndir)
+	for k := 0; k < ndir; k++ {
+		refCov[k] = doc.CovDir(k)
+	}
+
+	for b := 0; b < nboot; b++ {
+		weight := tripWeights(trips, rng)
+		rdoc := fitReplicate(ivb, tripVar, xnames, "Brake", weight, ndir)
+
+		md := alignSign(refMean, rdoc.MeanDir())
+		res.MeanDir = append(res.MeanDir, md)
+
+		for k := 0; k < ndir; k++ {
+			cd := alignSign(refCov[k], rdoc.CovDir(k))
+			res.CovDir[k] = append(res.CovDir[k], cd)
+		}
+	}
+
+	procrustesAlign(refCov, res.CovDir)
+
+	res.MeanDirBand = pointwisePercentiles(res.MeanDir)
+	res.CovDirBand = make([][3][]float64, ndir)
+	for k := 0; k < ndir; k++ {
+		res.CovDirBand[k] = pointwisePercentiles(res.CovDir[k])
+	}
+
+	return res
+}
+
+// alignSign flips the sign of rep so that its inner product with ref
+// is non-negative; direction vectors from an eigendecomposition are
+// only identified up to sign.
+func alignSign(ref, rep []float64) []float64 {
+	if floats.Dot(ref, rep) < 0 {
+		out := make([]float64, len(rep))
+		floats.AddScaled(out, -1, rep)
+		return out
+	}
+	out := make([]float64, len(rep))
+	copy(out, rep)
+	return out
+}
+
+// procrustesAlign jointly rotates the ndir covariance directions of
+// each bootstrap replicate to best match the point estimate, using
+// the classical orthogonal Procrustes solution: for rep (B) and ref
+// (A), the rotation R minimizing ||A - B*R|| is U*V^T from the SVD
+// B^T*A = U*S*V^T.  This is done in addition to, and after, the
+// per-direction sign flip, since with more than one direction a pure
+// sign flip cannot correct for directions that have been swapped or
+// rotated into each other.
+func procrustesAlign(ref [][]float64, rep [][][]float64) {
+	ndir := len(ref)
+	if ndir < 2 || len(rep[0]) == 0 {
+		return
+	}
+	p := len(ref[0])
+	nboot := len(rep[0])
+
+	a := mat64.NewDense(p, ndir, nil)
+	for k := 0; k < ndir; k++ {
+		for i := 0; i < p; i++ {
+			a.Set(i, k, ref[k][i])
+		}
+	}
+
+	for b := 0; b < nboot; b++ {
+		bm := mat64.NewDense(p, ndir, nil)
+		for k := 0; k < ndir; k++ {
+			for i := 0; i < p; i++ {
+				bm.Set(i, k, rep[k][b][i])
+			}
+		}
+
+		var m mat64.Dense
+		m.Mul(bm.T(), a)
+
+		var svd mat64.SVD
+		ok := svd.Factorize(&m, mat64.SVDFull)
+		if !ok {
+			continue
+		}
+		var u, v mat64.Dense
+		u.UFromSVD(&svd)
+		v.VFromSVD(&svd)
+
+		var rot mat64.Dense
+		rot.Mul(&u, v.T())
+
+		var aligned mat64.Dense
+		aligned.Mul(bm, &rot)
+
+		for k := 0; k < ndir; k++ {
+			for i := 0; i < p; i++ {
+				rep[k][b][i] = aligned.At(i, k)
+			}
+		}
+	}
+}
+
+// pointwisePercentiles computes the 2.5, 50 and 97.5 percentiles at
+// each position across a set of bootstrap replicate vectors.
+func pointwisePercentiles(reps [][]float64) [3][]float64 {
+	var band [3][]float64
+	if len(reps) == 0 {
+		return band
+	}
+	p := len(reps[0])
+	qs := []float64{0.025, 0.5, 0.975}
+	for bi := range band {
+		band[bi] = make([]float64, p)
+	}
+	col := make([]float64, len(reps))
+	for j := 0; j < p; j++ {
+		for i, r := range reps {
+			col[i] = r[j]
+		}
+		sort.Float64s(col)
+		for bi, q := range qs {
+			band[bi][j] = quantile(col, q)
+		}
+	}
+	return band
+}
+
+func quantile(sorted []float64, q float64) float64 {
+	n := len(sorted)
+	if n == 1 {
+		return sorted[0]
+	}
+	pos := q * float64(n-1)
+	lo := int(pos)
+	hi := lo + 1
+	if hi >= n {
+		return sorted[n-1]
+	}
+	frac := pos - float64(lo)
+	return sorted[lo]*(1-frac) + sorted[hi]*frac
+}
+
+// plotlinesBand draws one or more central curves together with a
+// shaded +/- percentile band around each, using the same plotconfig
+// conventions as plotlines.
+func plotlinesBand(x [][]float64, band [][3][]float64, names []string, pc plotconfig, fname string) error {
+
+	p, err := newPlot(pc)
+	if err != nil {
+		return err
+	}
+
+	for i, z := range x {
+		lo, hi := band[i][0], band[i][2]
+
+		poly := make(plotter.XYs, 0, 2*len(z))
+		for j := range z {
+			poly = append(poly, plotter.XY{X: float64(j), Y: hi[j]})
+		}
+		for j := len(z) - 1; j >= 0; j-- {
+			poly = append(poly, plotter.XY{X: float64(j), Y: lo[j]})
+		}
+		ribbon, err := plotter.NewPolygon(poly)
+		if err != nil {
+			return err
+		}
+		ribbon.Color = bandColor(i)
+		p.Add(ribbon)
+
+		line := make(plotter.XYs, len(z))
+		for j, v := range z {
+			line[j].X = float64(j)
+			line[j].Y = v
+		}
+		ln, err := plotter.NewLine(line)
+		if err != nil {
+			return err
+		}
+		ln.Color = lineColor(i)
+		p.Add(ln)
+		p.Legend.Add(names[i], ln)
+	}
+
+	return savePlot(p, fname)
+}
+
+// plotscatterBand draws a scatter of (x, y) together with a shaded
+// +/- percentile band evaluated at fixed quantiles of x, as produced
+// by SmoothBrakeProb or a bootstrap over it.
+func plotscatterBand(x, y, lo, hi []float64, pc plotconfig, fname string) error {
+
+	p, err := newPlot(pc)
+	if err != nil {
+		return err
+	}
+
+	poly := make(plotter.XYs, 0, 2*len(x))
+	for j := range x {
+		poly = append(poly, plotter.XY{X: x[j], Y: hi[j]})
+	}
+	for j := len(x) - 1; j >= 0; j-- {
+		poly = append(poly, plotter.XY{X: x[j], Y: lo[j]})
+	}
+	ribbon, err := plotter.NewPolygon(poly)
+	if err != nil {
+		return err
+	}
+	ribbon.Color = bandColor(0)
+	p.Add(ribbon)
+
+	z := make(plotter.XYs, len(x))
+	for i := range x {
+		z[i].X = x[i]
+		z[i].Y = y[i]
+	}
+	s, err := plotter.NewScatter(z)
+	if err != nil {
+		return err
+	}
+	p.Add(s)
+
+	return savePlot(p, fname)
+}
+
+// projectBrakeProb expands dir (expressed in terms of ivr.XNames())
+// back out to the full column set of ivb, projects ivb onto it with
+// Linapply, and returns the raw (score, Brake) pairs for the projected
+// score, for the caller to pass to SmoothBrakeProb.
+func projectBrakeProb(ivb dstream.Dstream, ivrXNames []string, dir []float64) (sc, br []float64) {
+
+	vm := make(map[string]int)
+	for k, a := range ivb.Names() {
+		vm[a] = k
+	}
+	x := make([]float64, len(vm))
+	for k, na := range ivrXNames {
+		x[vm[na]] = dir[k]
+	}
+
+	proj := dstream.Linapply(ivb, [][]float64{x}, "dr")
+	proj.Reset()
+	ux := dstream.GetCol(proj, "dr0").([]float64)
+	proj.Reset()
+	uy := dstream.GetCol(proj, "Brake").([]float64)
+
+	return ux, uy
+}
+
+// projectBrakeProbWeighted is the bootstrap-replicate counterpart of
+// projectBrakeProb: it projects ivb (which must still carry tripVar)
+// onto dir exactly as projectBrakeProb does, but then replicates each
+// row's (score, Brake) pair weight[trip] times, so that a trip with
+// weight w really contributes w copies of itself to the replicate
+// rather than being included at most once.
+func projectBrakeProbWeighted(ivb dstream.Dstream, tripVar string, ivrXNames []string, dir []float64, weight map[float64]int) (sc, br []float64) {
+
+	vm := make(map[string]int)
+	for k, a := range ivb.Names() {
+		vm[a] = k
+	}
+	x := make([]float64, len(vm))
+	for k, na := range ivrXNames {
+		x[vm[na]] = dir[k]
+	}
+
+	proj := dstream.Linapply(ivb, [][]float64{x}, "dr")
+	proj.Reset()
+	trip := dstream.GetCol(proj, tripVar).([]float64)
+	proj.Reset()
+	ux := dstream.GetCol(proj, "dr0").([]float64)
+	proj.Reset()
+	uy := dstream.GetCol(proj, "Brake").([]float64)
+
+	for i := range ux {
+		n := weight[trip[i]]
+		for j := 0; j < n; j++ {
+			sc = append(sc, ux[i])
+			br = append(br, uy[i])
+		}
+	}
+
+	return sc, br
+}
+
+// interpAt linearly interpolates the curve (sc, br) (sc assumed
+// sorted ascending, as produced by SmoothBrakeProb) at the query
+// points in grid, clamping to the endpoint values outside the
+// observed range.
+func interpAt(sc, br, grid []float64) []float64 {
+	out := make([]float64, len(grid))
+	for i, x := range grid {
+		j := sort.SearchFloat64s(sc, x)
+		switch {
+		case j <= 0:
+			out[i] = br[0]
+		case j >= len(sc):
+			out[i] = br[len(br)-1]
+		default:
+			frac := (x - sc[j-1]) / (sc[j] - sc[j-1])
+			out[i] = br[j-1] + frac*(br[j]-br[j-1])
+		}
+	}
+	return out
+}
+
+// quantileGrid returns n evenly spaced quantiles of x (excluding the
+// extreme 0th and 100th, which are unstable to estimate near the
+// edges of the observed range), used as the fixed evaluation grid for
+// the bootstrap brake probability bands.
+func quantileGrid(x []float64, n int) []float64 {
+	sorted := make([]float64, len(x))
+	copy(sorted, x)
+	sort.Float64s(sorted)
+
+	grid := make([]float64, n)
+	for i := 0; i < n; i++ {
+		q := (float64(i) + 1) / float64(n+1)
+		grid[i] = quantile(sorted, q)
+	}
+	return grid
+}
+
+// BootstrapBrakeProb runs a block bootstrap over trips to put
+// pointwise 2.5/50/97.5 percentile bands on the SmoothBrakeProb curve
+// for a fitted direction.  dir is the fitted direction (Mean or Cov)
+// expressed in ivrXNames order; replicateDir extracts the matching
+// direction (e.g. rdoc.MeanDir or
+// func(d *DOCState) []float64 { return d.CovDir(0) }) from each
+// bootstrap refit so it can be sign-aligned to dir.  ivbTrip is the
+// pre-DropCols stream that still carries tripVar.  The bands are
+// evaluated at a fixed grid of score quantiles (from the point
+// estimate's own score) rather than at each replicate's own score
+// values, since those differ resample to resample.
+func BootstrapBrakeProb(ivbTrip dstream.Dstream, tripVar string, ivrXNames []string, dir []float64, replicateDir func(*DOCState) []float64, ndir, ngrid, nboot int, seed int64, smoothOpts SmoothOptions) (grid, lo, mid, hi []float64) {
+
+	refSc, refBr := projectBrakeProb(ivbTrip, ivrXNames, dir)
+	refX, refPhat, _ := SmoothBrakeProb(refSc, refBr, smoothOpts)
+	grid = quantileGrid(refSc, ngrid)
+	refCurve := interpAt(refX, refPhat, grid)
+
+	rng := rand.New(rand.NewSource(seed))
+	trips := uniqueTrips(ivbTrip, tripVar)
+
+	var reps [][]float64
+	for b := 0; b < nboot; b++ {
+		weight := tripWeights(trips, rng)
+		rdoc := fitReplicate(ivbTrip, tripVar, ivrXNames, "Brake", weight, ndir)
+		rdir := alignSign(dir, replicateDir(rdoc))
+
+		sc, br := projectBrakeProbWeighted(ivbTrip, tripVar, ivrXNames, rdir, weight)
+		x, phat, _ := SmoothBrakeProb(sc, br, smoothOpts)
+		reps = append(reps, interpAt(x, phat, grid))
+	}
+
+	band := pointwisePercentiles(reps)
+	return grid, band[0], refCurve, band[2]
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestQuantile(t *testing.T) {
+	sorted := []float64{1, 2, 3, 4, 5}
+	cases := []struct {
+		q    float64
+		want float64
+	}{
+		{0, 1},
+		{1, 5},
+		{0.5, 3},
+	}
+	for _, c := range cases {
+		if got := quantile(sorted, c.q); got != c.want {
+			t.Errorf("quantile(%v, %v) = %v, want %v", sorted, c.q, got, c.want)
+		}
+	}
+}
+
+func TestAlignSign(t *testing.T) {
+	ref := []float64{1, 0, 0}
+
+	flipped := alignSign(ref, []float64{-1, 0, 0})
+	want := []float64{1, 0, 0}
+	for i := range want {
+		if flipped[i] != want[i] {
+			t.Errorf("alignSign(%v, [-1 0 0]) = %v, want %v", ref, flipped, want)
+			break
+		}
+	}
+
+	same := []float64{1, 0, 0}
+	aligned := alignSign(ref, same)
+	for i := range same {
+		if aligned[i] != same[i] {
+			t.Errorf("alignSign changed an already-aligned vector: got %v, want %v", aligned, same)
+			break
+		}
+	}
+}
+
+// TestProcrustesAlign builds a replicate whose two direction vectors
+// are the point estimate's, rotated by a known angle, and checks that
+// procrustesAlign recovers the point estimate (up to floating-point
+// error). This catches the class of bug where the cross-product
+// matrix is built in the wrong operand order and the solved rotation
+// ends up being the inverse of the correct one.
+func TestProcrustesAlign(t *testing.T) {
+	ref := [][]float64{
+		{1, 0, 0},
+		{0, 1, 0},
+	}
+
+	theta := math.Pi / 6
+	c, s := math.Cos(theta), math.Sin(theta)
+
+	// rep = ref rotated by theta in the plane spanned by the two
+	// direction vectors: rep[0] = c*ref[0] + s*ref[1], rep[1] =
+	// -s*ref[0] + c*ref[1]. procrustesAlign should undo this
+	// rotation and bring rep back to ref.
+	rep := [][][]float64{
+		{{c, s, 0}},
+		{{-s, c, 0}},
+	}
+
+	procrustesAlign(ref, rep)
+
+	const tol = 1e-9
+	for k := range ref {
+		for i := range ref[k] {
+			if math.Abs(rep[k][0][i]-ref[k][i]) > tol {
+				t.Errorf("procrustesAlign: rep[%d][0] = %v, want %v (within %v)", k, rep[k][0], ref[k], tol)
+				break
+			}
+		}
+	}
+}
+
+func TestPointwisePercentiles(t *testing.T) {
+	reps := [][]float64{
+		{1, 10},
+		{2, 20},
+		{3, 30},
+		{4, 40},
+		{5, 50},
+	}
+	band := pointwisePercentiles(reps)
+
+	if band[1][0] != 3 {
+		t.Errorf("median at position 0 = %v, want 3", band[1][0])
+	}
+	if band[1][1] != 30 {
+		t.Errorf("median at position 1 = %v, want 30", band[1][1])
+	}
+	for j := 0; j < 2; j++ {
+		if band[0][j] > band[1][j] || band[1][j] > band[2][j] {
+			t.Errorf("percentile bands not ordered at position %d: %v", j, band)
+		}
+	}
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"math"
+	"sort"
+
+	"github.com/gonum/floats"
+	"github.com/gonum/matrix/mat64"
+	"github.com/kshedden/dstream/dstream"
+)
+
+// DimReducer is the common interface implemented by the SIR and SAVE
+// backends below: it extends docFit (the interface also satisfied by
+// DOCState) with the Init/Fit lifecycle methods main uses to drive a
+// fresh fit before handing the result off to the same docFit-based
+// plotting code used for all three backends.
+type DimReducer interface {
+	docFit
+	Init()
+	Fit(ndir int)
+}
+
+// sliceStats holds the streamed sufficient statistics needed by both
+// SIR and SAVE: the overall and per-slice first and second moments of
+// X, accumulated in a single pass over the dstream chunks so that X
+// never needs to be materialized in memory.
+type sliceStats struct {
+	p int
+	h int
+
+	n     float64
+	sum   []float64 // p
+	sumxx []float64 // p*p, row-major
+
+	nSlice     []float64   // h
+	sumSlice   [][]float64 // h x p
+	sumxxSlice [][]float64 // h x p*p
+}
+
+func newSliceStats(p, h int) *sliceStats {
+	s := &sliceStats{
+		p: p, h: h,
+		sum:        make([]float64, p),
+		sumxx:      make([]float64, p*p),
+		nSlice:     make([]float64, h),
+		sumSlice:   make([][]float64, h),
+		sumxxSlice: make([][]float64, h),
+	}
+	for k := 0; k < h; k++ {
+		s.sumSlice[k] = make([]float64, p)
+		s.sumxxSlice[k] = make([]float64, p*p)
+	}
+	return s
+}
+
+func (s *sliceStats) add(x []float64, slice int) {
+	s.n++
+	s.nSlice[slice]++
+	for i := 0; i < s.p; i++ {
+		s.sum[i] += x[i]
+		s.sumSlice[slice][i] += x[i]
+	}
+	for i := 0; i < s.p; i++ {
+		for j := 0; j <= i; j++ {
+			v := x[i] * x[j]
+			s.sumxx[i*s.p+j] += v
+			s.sumxx[j*s.p+i] += v
+			s.sumxxSlice[slice][i*s.p+j] += v
+			s.sumxxSlice[slice][j*s.p+i] += v
+		}
+		// Undo the double-add on the diagonal from the j<=i loop above.
+		s.sumxx[i*s.p+i] -= x[i] * x[i]
+		s.sumxxSlice[slice][i*s.p+i] -= x[i] * x[i]
+	}
+}
+
+func (s *sliceStats) mean() []float64 {
+	m := make([]float64, s.p)
+	copy(m, s.sum)
+	floats.Scale(1/s.n, m)
+	return m
+}
+
+func (s *sliceStats) cov() []float64 {
+	m := s.mean()
+	c := make([]float64, s.p*s.p)
+	for i := 0; i < s.p; i++ {
+		for j := 0; j < s.p; j++ {
+			c[i*s.p+j] = s.sumxx[i*s.p+j]/s.n - m[i]*m[j]
+		}
+	}
+	return c
+}
+
+func (s *sliceStats) sliceMean(k int) []float64 {
+	m := make([]float64, s.p)
+	copy(m, s.sumSlice[k])
+	if s.nSlice[k] > 0 {
+		floats.Scale(1/s.nSlice[k], m)
+	}
+	return m
+}
+
+func (s *sliceStats) sliceCov(k int) []float64 {
+	m := s.sliceMean(k)
+	c := make([]float64, s.p*s.p)
+	if s.nSlice[k] == 0 {
+		return c
+	}
+	for i := 0; i < s.p; i++ {
+		for j := 0; j < s.p; j++ {
+			c[i*s.p+j] = s.sumxxSlice[k][i*s.p+j]/s.nSlice[k] - m[i]*m[j]
+		}
+	}
+	return c
+}
+
+// sliceIndex assigns response value y to one of h slices.  For a
+// binary response (h==2, the case used throughout this package) the
+// slices are just the two classes.  For a continuous response with
+// h>2, breaks holds the h-1 interior quantile cut points used to
+// bucket y.
+func sliceIndex(y float64, h int, breaks []float64) int {
+	if h == 2 && len(breaks) == 0 {
+		if y == 1 {
+			return 1
+		}
+		return 0
+	}
+	k := sort.SearchFloat64s(breaks, y)
+	if k >= h {
+		k = h - 1
+	}
+	return k
+}
+
+// quantileBreaksOf returns the h-1 interior quantile cut points of y,
+// used to bucket a continuous response into h slices.
+func quantileBreaksOf(y []float64, h int) []float64 {
+	sorted := make([]float64, len(y))
+	copy(sorted, y)
+	sort.Float64s(sorted)
+	breaks := make([]float64, h-1)
+	for i := range breaks {
+		breaks[i] = quantile(sorted, float64(i+1)/float64(h))
+	}
+	return breaks
+}
+
+// accumulateSliceStats streams over ivb once, computing the overall
+// and per-slice moments of the variables named in xnames, slicing on
+// respvar.
+func accumulateSliceStats(ivb dstream.Dstream, xnames []string, respvar string, h int) *sliceStats {
+
+	var xpos []int
+	for _, nm := range xnames {
+		xpos = append(xpos, getPos(ivb, nm))
+	}
+	ypos := getPos(ivb, respvar)
+
+	// A continuous response requires the quantile breakpoints up
+	// front, which in turn requires a pass over y; for the binary
+	// Brake response used elsewhere in this package h==2 and no
+	// extra pass is needed.
+	var breaks []float64
+	if h > 2 {
+		ivb.Reset()
+		var y []float64
+		for ivb.Next() {
+			y = append(y, ivb.GetPos(ypos).([]float64)...)
+		}
+		breaks = quantileBreaksOf(y, h)
+	}
+
+	st := newSliceStats(len(xnames), h)
+
+	ivb.Reset()
+	x := make([]float64, len(xnames))
+	for ivb.Next() {
+		cols := make([][]float64, len(xpos))
+		for j, p := range xpos {
+			cols[j] = ivb.GetPos(p).([]float64)
+		}
+		yv := ivb.GetPos(ypos).([]float64)
+		for i := range yv {
+			for j, c := range cols {
+				x[j] = c[i]
+			}
+			st.add(x, sliceIndex(yv[i], h, breaks))
+		}
+	}
+
+	return st
+}
+
+// symEigen returns the eigenvalues (ascending) and eigenvectors
+// (columns, matching order) of the p x p symmetric matrix a.
+func symEigen(a []float64, p int) (vals []float64, vecs *mat64.Dense) {
+	sym := mat64.NewSymDense(p, a)
+	var es mat64.EigenSym
+	es.Factorize(sym, true)
+	return es.Values(nil), es.Vectors()
+}
+
+// symInvSqrt returns Sigma^{-1/2} for the p x p symmetric, positive
+// definite matrix sigma, via its eigendecomposition.
+func symInvSqrt(sigma []float64, p int) *mat64.Dense {
+	vals, vecs := symEigen(sigma, p)
+	d := mat64.NewDense(p, p, nil)
+	for i := 0; i < p; i++ {
+		if vals[i] > 1e-10 {
+			d.Set(i, i, 1/math.Sqrt(vals[i]))
+		}
+	}
+	var tmp, out mat64.Dense
+	tmp.Mul(vecs, d)
+	out.Mul(&tmp, vecs.T())
+	return &out
+}
+
+// topEigenvectors returns the d eigenvectors of the p x p symmetric
+// matrix a with the largest eigenvalues, each as a length-p slice.
+func topEigenvectors(a []float64, p, d int) [][]float64 {
+	vals, vecs := symEigen(a, p)
+	idx := make([]int, p)
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Slice(idx, func(i, j int) bool { return vals[idx[i]] > vals[idx[j]] })
+
+	out := make([][]float64, d)
+	for k := 0; k < d && k < p; k++ {
+		v := make([]float64, p)
+		for i := 0; i < p; i++ {
+			v[i] = vecs.At(i, idx[k])
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// topEigenvectorsAbs returns the d eigenvectors of the p x p
+// symmetric matrix a whose eigenvalues have the largest absolute
+// value.  Unlike topEigenvectors (which is appropriate for a
+// covariance-like matrix whose leading directions are always the
+// largest eigenvalues), a covariance *difference* is indefinite, and
+// either a large positive or a large negative eigenvalue identifies a
+// direction along which the two classes' variances differ most.
+func topEigenvectorsAbs(a []float64, p, d int) [][]float64 {
+	vals, vecs := symEigen(a, p)
+	idx := make([]int, p)
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Slice(idx, func(i, j int) bool { return math.Abs(vals[idx[i]]) > math.Abs(vals[idx[j]]) })
+
+	out := make([][]float64, d)
+	for k := 0; k < d && k < p; k++ {
+		v := make([]float64, p)
+		for i := 0; i < p; i++ {
+			v[i] = vecs.At(i, idx[k])
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// docDirections derives a DOC-style mean direction and top-ndir
+// covariance directions from per-class sufficient statistics: the
+// mean direction is the difference of the class means standardized
+// by the pooled within-class covariance (standardize, in basic2.go),
+// and the covariance directions are the top eigenvectors (by absolute
+// eigenvalue) of the difference of the class covariances, each
+// standardized the same way.  count, mean and cov are indexed by
+// class (0 = non-braking, 1 = braking).
+func docDirections(count []float64, mean, cov [][]float64, ndir int) (meanDir []float64, covDirs [][]float64) {
+	p := len(mean[0])
+	total := count[0] + count[1]
+
+	pooled := make([]float64, p*p)
+	for k := 0; k < 2; k++ {
+		w := count[k] / total
+		for i := range pooled {
+			pooled[i] += w * cov[k][i]
+		}
+	}
+
+	meanDir = diffVec(mean[1], mean[0])
+	standardize(meanDir, pooled)
+
+	diffCov := make([]float64, p*p)
+	for i := range diffCov {
+		diffCov[i] = cov[1][i] - cov[0][i]
+	}
+
+	vecs := topEigenvectorsAbs(diffCov, p, ndir)
+	covDirs = make([][]float64, len(vecs))
+	for k, v := range vecs {
+		cp := append([]float64{}, v...)
+		standardize(cp, pooled)
+		covDirs[k] = cp
+	}
+
+	return meanDir, covDirs
+}
+
+func matVec(m *mat64.Dense, v []float64) []float64 {
+	p, _ := m.Dims()
+	vv := mat64.NewVector(len(v), v)
+	var out mat64.Vector
+	out.MulVec(m, vv)
+	res := make([]float64, p)
+	for i := 0; i < p; i++ {
+		res[i] = out.At(i, 0)
+	}
+	return res
+}
+
+// SIR implements sliced inverse regression: it standardizes X to
+// identity covariance via Sigma^{-1/2}, forms M = sum_h p_h m_h m_h'
+// from the slice means m_h, and returns the top eigenvectors of M
+// transformed back by Sigma^{-1/2}.
+type SIR struct {
+	ivb     dstream.Dstream
+	xnames  []string
+	respvar string
+	h       int
+
+	st   *sliceStats
+	dirs [][]float64
+}
+
+// NewSIR constructs a SIR backend that slices respvar (taken to be
+// binary unless h > 2) into h slices and reduces the variables named
+// in xnames, streaming over ivb's chunks.
+func NewSIR(ivb dstream.Dstream, xnames []string, respvar string, h int) *SIR {
+	if h < 2 {
+		h = 2
+	}
+	return &SIR{ivb: ivb, xnames: xnames, respvar: respvar, h: h}
+}
+
+// Init accumulates the streaming sufficient statistics.
+func (s *SIR) Init() {
+	s.st = accumulateSliceStats(s.ivb, s.xnames, s.respvar, s.h)
+}
+
+// Fit computes the top ndir SIR directions.
+func (s *SIR) Fit(ndir int) {
+	p := s.st.p
+	sigma := s.st.cov()
+	invSqrt := symInvSqrt(sigma, p)
+
+	m := make([]float64, p*p)
+	for k := 0; k < s.h; k++ {
+		pk := s.st.nSlice[k] / s.st.n
+		if pk == 0 {
+			continue
+		}
+		mh := matVec(invSqrt, diffVec(s.st.sliceMean(k), s.st.mean()))
+		for i := 0; i < p; i++ {
+			for j := 0; j < p; j++ {
+				m[i*p+j] += pk * mh[i] * mh[j]
+			}
+		}
+	}
+
+	vecs := topEigenvectors(m, p, ndir)
+	s.dirs = make([][]float64, len(vecs))
+	for k, v := range vecs {
+		s.dirs[k] = matVec(invSqrt, v)
+	}
+}
+
+func diffVec(a, b []float64) []float64 {
+	out := make([]float64, len(a))
+	for i := range a {
+		out[i] = a[i] - b[i]
+	}
+	return out
+}
+
+// MeanDir returns the leading SIR direction.
+func (s *SIR) MeanDir() []float64 { return s.dirs[0] }
+
+// CovDir returns the k^th SIR direction (k==0 is the same as MeanDir;
+// SIR does not distinguish mean and covariance directions the way
+// DOC does, so the remaining slots index the lower-ranked directions).
+func (s *SIR) CovDir(k int) []float64 { return s.dirs[k] }
+
+// YMean returns the k^th slice mean, for compatibility with plotting
+// code written against DOCState's per-class output.
+func (s *SIR) YMean(k int) []float64 { return s.st.sliceMean(k) }
+
+// YCov returns the k^th slice covariance.
+func (s *SIR) YCov(k int) []float64 { return s.st.sliceCov(k) }
+
+// SAVE implements sliced average variance estimation: in addition to
+// the slice means used by SIR, it uses the per-slice covariances V_h
+// and eigendecomposes sum_h p_h (I - Sigma^{-1/2} V_h Sigma^{-1/2})^2.
+type SAVE struct {
+	ivb     dstream.Dstream
+	xnames  []string
+	respvar string
+	h       int
+
+	st   *sliceStats
+	dirs [][]float64
+}
+
+// NewSAVE constructs a SAVE backend, analogous to NewSIR.
+func NewSAVE(ivb dstream.Dstream, xnames []string, respvar string, h int) *SAVE {
+	if h < 2 {
+		h = 2
+	}
+	return &SAVE{ivb: ivb, xnames: xnames, respvar: respvar, h: h}
+}
+
+// Init accumulates the streaming sufficient statistics.
+func (s *SAVE) Init() {
+	s.st = accumulateSliceStats(s.ivb, s.xnames, s.respvar, s.h)
+}
+
+// Fit computes the top ndir SAVE directions.
+func (s *SAVE) Fit(ndir int) {
+	p := s.st.p
+	sigma := s.st.cov()
+	invSqrt := symInvSqrt(sigma, p)
+
+	acc := mat64.NewDense(p, p, nil)
+	ident := mat64.NewDense(p, p, nil)
+	for i := 0; i < p; i++ {
+		ident.Set(i, i, 1)
+	}
+
+	for k := 0; k < s.h; k++ {
+		pk := s.st.nSlice[k] / s.st.n
+		if pk == 0 {
+			continue
+		}
+		vh := mat64.NewDense(p, p, s.st.sliceCov(k))
+
+		var tmp, standardized, diff, sq mat64.Dense
+		tmp.Mul(invSqrt, vh)
+		standardized.Mul(&tmp, invSqrt)
+		diff.Sub(ident, &standardized)
+		sq.Mul(&diff, &diff)
+
+		for i := 0; i < p; i++ {
+			for j := 0; j < p; j++ {
+				acc.Set(i, j, acc.At(i, j)+pk*sq.At(i, j))
+			}
+		}
+	}
+
+	m := make([]float64, p*p)
+	for i := 0; i < p; i++ {
+		for j := 0; j < p; j++ {
+			m[i*p+j] = acc.At(i, j)
+		}
+	}
+
+	vecs := topEigenvectors(m, p, ndir)
+	s.dirs = make([][]float64, len(vecs))
+	for k, v := range vecs {
+		s.dirs[k] = matVec(invSqrt, v)
+	}
+}
+
+// MeanDir returns the leading SAVE direction.
+func (s *SAVE) MeanDir() []float64 { return s.dirs[0] }
+
+// CovDir returns the k^th SAVE direction.
+func (s *SAVE) CovDir(k int) []float64 { return s.dirs[k] }
+
+// YMean returns the k^th slice mean.
+func (s *SAVE) YMean(k int) []float64 { return s.st.sliceMean(k) }
+
+// YCov returns the k^th slice covariance.
+func (s *SAVE) YCov(k int) []float64 { return s.st.sliceCov(k) }
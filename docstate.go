@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gonum/floats"
+	"github.com/kshedden/dstream/dstream"
+)
+
+// DOCState holds the running, per-class sufficient statistics behind
+// a DOC-style fit: a standardized mean difference and the top
+// eigenvectors of the covariance difference between the two classes
+// of Brake (see docDirections in dimreduce.go).  Unlike wrapping a
+// single atomic external Fit call, these statistics are additive, so
+// they can be updated one dstream chunk at a time (AccumulateDOCState
+// below), checkpointed to disk after every chunk with SaveDOCState,
+// resumed with LoadDOCState, and combined across separate input
+// files with MergeDOCState.
+type DOCState struct {
+	VarNames    []string
+	MaxSpeedLag int
+	MaxRangeLag int
+	NDir        int
+	NObs        int
+
+	// ChunksDone is the number of dstream chunks already folded
+	// into Count/Sum/SumSq, so that AccumulateDOCState can skip
+	// them (without re-adding) when resuming.
+	ChunksDone int
+
+	// Per-class running sufficient statistics: Count[k] is the
+	// (possibly weighted, see bootstrap.go) number of observations
+	// folded into class k so far, Sum[k] the running sum of each
+	// variable, and SumSq[k] the running sum of cross products
+	// (both triangles filled, row-major, matching the layout used
+	// by plotcov).
+	Count []float64
+	Sum   [][]float64
+	SumSq [][]float64
+
+	// Fitted outputs, recomputed from Count/Sum/SumSq every time
+	// finalize is called.
+	MeanDirVec []float64
+	CovDirVecs [][]float64
+}
+
+// NewDOCState returns a zeroed DOCState over the two classes of
+// Brake, ready to be passed to Add.
+func NewDOCState(varNames []string, ndir int) *DOCState {
+	p := len(varNames)
+	st := &DOCState{
+		VarNames:    varNames,
+		MaxSpeedLag: maxSpeedLag,
+		MaxRangeLag: maxRangeLag,
+		NDir:        ndir,
+		Count:       make([]float64, 2),
+		Sum:         make([][]float64, 2),
+		SumSq:       make([][]float64, 2),
+	}
+	for k := 0; k < 2; k++ {
+		st.Sum[k] = make([]float64, p)
+		st.SumSq[k] = make([]float64, p*p)
+	}
+	return st
+}
+
+// Add folds one observation x, belonging to class k, into the
+// running sufficient statistics with the given weight.  weight is 1
+// for a plain accumulation and a trip's replicate multiplicity for a
+// bootstrap resample (see fitReplicate in bootstrap.go).
+func (st *DOCState) Add(k int, x []float64, weight float64) {
+	st.Count[k] += weight
+	p := len(x)
+	for i := 0; i < p; i++ {
+		st.Sum[k][i] += weight * x[i]
+	}
+	for i := 0; i < p; i++ {
+		for j := 0; j < p; j++ {
+			st.SumSq[k][i*p+j] += weight * x[i] * x[j]
+		}
+	}
+}
+
+// finalize recomputes MeanDirVec/CovDirVecs from the current
+// Count/Sum/SumSq.  This is cheap relative to a pass over the data,
+// so AccumulateDOCState calls it after every chunk.
+func (st *DOCState) finalize(ndir int) {
+	if st.Count[0] == 0 || st.Count[1] == 0 {
+		return
+	}
+	st.NDir = ndir
+	mean := [][]float64{st.YMean(0), st.YMean(1)}
+	cov := [][]float64{st.YCov(0), st.YCov(1)}
+	st.MeanDirVec, st.CovDirVecs = docDirections(st.Count, mean, cov, ndir)
+}
+
+// YMean returns the class-k mean vector.
+func (st *DOCState) YMean(k int) []float64 {
+	p := len(st.VarNames)
+	m := make([]float64, p)
+	if st.Count[k] == 0 {
+		return m
+	}
+	for i := 0; i < p; i++ {
+		m[i] = st.Sum[k][i] / st.Count[k]
+	}
+	return m
+}
+
+// YCov returns the class-k covariance matrix.
+func (st *DOCState) YCov(k int) []float64 {
+	p := len(st.VarNames)
+	c := make([]float64, p*p)
+	if st.Count[k] == 0 {
+		return c
+	}
+	m := st.YMean(k)
+	for i := 0; i < p; i++ {
+		for j := 0; j < p; j++ {
+			c[i*p+j] = st.SumSq[k][i*p+j]/st.Count[k] - m[i]*m[j]
+		}
+	}
+	return c
+}
+
+// MeanDir returns the fitted mean direction.
+func (st *DOCState) MeanDir() []float64 { return st.MeanDirVec }
+
+// CovDir returns the k^th fitted covariance direction.
+func (st *DOCState) CovDir(k int) []float64 { return st.CovDirVecs[k] }
+
+// MergeDOCState combines the running sufficient statistics of a and b
+// into a new DOCState, so that partial states accumulated separately
+// (for example from several input files) can be combined before the
+// directions are (re-)finalized.  a and b must share the same
+// VarNames.  The result's ChunksDone is set to -1 rather than copied
+// from a or b: a merged state mixes chunks from more than one input
+// stream, so "chunks done" no longer identifies a prefix of any single
+// stream, and AccumulateDOCState refuses to resume from it.
+func MergeDOCState(a, b *DOCState) (*DOCState, error) {
+	if len(a.VarNames) != len(b.VarNames) {
+		return nil, fmt.Errorf("MergeDOCState: variable count mismatch (%d vs %d)", len(a.VarNames), len(b.VarNames))
+	}
+	for i := range a.VarNames {
+		if a.VarNames[i] != b.VarNames[i] {
+			return nil, fmt.Errorf("MergeDOCState: variable name mismatch at position %d (%q vs %q)", i, a.VarNames[i], b.VarNames[i])
+		}
+	}
+
+	ndir := a.NDir
+	if ndir == 0 {
+		ndir = b.NDir
+	}
+
+	m := NewDOCState(a.VarNames, ndir)
+	m.NObs = a.NObs + b.NObs
+	m.ChunksDone = -1
+	for k := 0; k < 2; k++ {
+		m.Count[k] = a.Count[k] + b.Count[k]
+		floats.AddTo(m.Sum[k], a.Sum[k], b.Sum[k])
+		floats.AddTo(m.SumSq[k], a.SumSq[k], b.SumSq[k])
+	}
+	m.finalize(ndir)
+
+	return m, nil
+}
+
+// AccumulateDOCState streams over ivb one dstream chunk at a time,
+// updating the per-class sufficient statistics behind a DOC fit and
+// writing a checkpoint to checkpointPath after every chunk, so that a
+// crash loses at most the chunk currently in flight.  If resume is
+// non-nil, its ChunksDone chunks are consumed but not re-added,
+// continuing the accumulation it already holds; pass nil to fit from
+// scratch.  resume must not be a state produced by MergeDOCState (its
+// ChunksDone is -1 and is rejected below), since there is no single
+// input stream whose chunks it corresponds to.
+func AccumulateDOCState(ivb dstream.Dstream, respvar string, xnames []string, ndir int, checkpointPath string, resume *DOCState) (*DOCState, error) {
+
+	if resume != nil && resume.ChunksDone < 0 {
+		return nil, fmt.Errorf("AccumulateDOCState: cannot resume from a merged DOCState (ChunksDone=%d); merged states combine chunks from more than one input stream", resume.ChunksDone)
+	}
+
+	xpos := make([]int, len(xnames))
+	for i, nm := range xnames {
+		xpos[i] = getPos(ivb, nm)
+	}
+	ypos := getPos(ivb, respvar)
+
+	st := resume
+	if st == nil {
+		st = NewDOCState(xnames, ndir)
+	}
+	skip := st.ChunksDone
+
+	ivb.Reset()
+	x := make([]float64, len(xnames))
+	chunk := 0
+	for ivb.Next() {
+		if chunk < skip {
+			chunk++
+			continue
+		}
+
+		cols := make([][]float64, len(xpos))
+		for j, p := range xpos {
+			cols[j] = ivb.GetPos(p).([]float64)
+		}
+		yv := ivb.GetPos(ypos).([]float64)
+
+		for i := range yv {
+			for j, c := range cols {
+				x[j] = c[i]
+			}
+			k := 0
+			if yv[i] == 1 {
+				k = 1
+			}
+			st.Add(k, x, 1)
+		}
+
+		st.NObs += len(yv)
+		chunk++
+		st.ChunksDone = chunk
+		st.finalize(ndir)
+		if err := SaveDOCState(st, checkpointPath); err != nil {
+			return nil, err
+		}
+	}
+
+	return st, nil
+}
+
+// SaveDOCState writes the running state of a DOC fit to path as a
+// portable tab-separated table, so that a fit processing many chunks
+// can be checkpointed after each one and later resumed with
+// LoadDOCState.
+func SaveDOCState(st *DOCState, path string) error {
+
+	fid, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+
+	w := bufio.NewWriter(fid)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "nobs\t%d\n", st.NObs)
+	fmt.Fprintf(w, "chunksdone\t%d\n", st.ChunksDone)
+	fmt.Fprintf(w, "ndir\t%d\n", st.NDir)
+	fmt.Fprintf(w, "maxspeedlag\t%d\n", st.MaxSpeedLag)
+	fmt.Fprintf(w, "maxrangelag\t%d\n", st.MaxRangeLag)
+
+	fmt.Fprintf(w, "varnames")
+	for _, v := range st.VarNames {
+		fmt.Fprintf(w, "\t%s", v)
+	}
+	fmt.Fprintf(w, "\n")
+
+	for k := 0; k < len(st.Count); k++ {
+		fmt.Fprintf(w, "count%d\t%v\n", k, st.Count[k])
+		writeRow(w, fmt.Sprintf("sum%d", k), st.Sum[k])
+		writeRow(w, fmt.Sprintf("sumsq%d", k), st.SumSq[k])
+	}
+
+	if st.MeanDirVec != nil {
+		writeRow(w, "meandir", st.MeanDirVec)
+		for k, v := range st.CovDirVecs {
+			writeRow(w, fmt.Sprintf("covdir%d", k), v)
+		}
+	}
+
+	return nil
+}
+
+func writeRow(w *bufio.Writer, name string, x []float64) {
+	fmt.Fprintf(w, "%s", name)
+	for _, v := range x {
+		fmt.Fprintf(w, "\t%v", v)
+	}
+	fmt.Fprintf(w, "\n")
+}
+
+// LoadDOCState reads back a DOCState previously written by
+// SaveDOCState, so that an interrupted fit can be resumed from the
+// chunk it last completed, or so that states from several input
+// files can be merged with MergeDOCState before refitting the
+// directions.
+func LoadDOCState(path string) (*DOCState, error) {
+
+	fid, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fid.Close()
+
+	st := &DOCState{}
+	sum := make(map[int][]float64)
+	sumsq := make(map[int][]float64)
+	count := make(map[int]float64)
+	covdir := make(map[int][]float64)
+
+	scanner := bufio.NewScanner(fid)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		switch {
+		case fields[0] == "nobs":
+			st.NObs, _ = strconv.Atoi(fields[1])
+		case fields[0] == "chunksdone":
+			st.ChunksDone, _ = strconv.Atoi(fields[1])
+		case fields[0] == "ndir":
+			st.NDir, _ = strconv.Atoi(fields[1])
+		case fields[0] == "maxspeedlag":
+			st.MaxSpeedLag, _ = strconv.Atoi(fields[1])
+		case fields[0] == "maxrangelag":
+			st.MaxRangeLag, _ = strconv.Atoi(fields[1])
+		case fields[0] == "varnames":
+			st.VarNames = fields[1:]
+		case fields[0] == "meandir":
+			st.MeanDirVec = parseFloats(fields[1:])
+		case strings.HasPrefix(fields[0], "count"):
+			k, _ := strconv.Atoi(fields[0][len("count"):])
+			count[k], _ = strconv.ParseFloat(fields[1], 64)
+		case strings.HasPrefix(fields[0], "sumsq"):
+			k, _ := strconv.Atoi(fields[0][len("sumsq"):])
+			sumsq[k] = parseFloats(fields[1:])
+		case strings.HasPrefix(fields[0], "covdir"):
+			k, _ := strconv.Atoi(fields[0][len("covdir"):])
+			covdir[k] = parseFloats(fields[1:])
+		case strings.HasPrefix(fields[0], "sum"):
+			k, _ := strconv.Atoi(fields[0][len("sum"):])
+			sum[k] = parseFloats(fields[1:])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	st.Sum = make([][]float64, len(sum))
+	st.SumSq = make([][]float64, len(sumsq))
+	st.Count = make([]float64, len(count))
+	for k := range sum {
+		st.Sum[k] = sum[k]
+		st.SumSq[k] = sumsq[k]
+		st.Count[k] = count[k]
+	}
+	st.CovDirVecs = make([][]float64, len(covdir))
+	for k := range covdir {
+		st.CovDirVecs[k] = covdir[k]
+	}
+
+	return st, nil
+}
+
+func parseFloats(fields []string) []float64 {
+	x := make([]float64, len(fields))
+	for i, f := range fields {
+		x[i], _ = strconv.ParseFloat(f, 64)
+	}
+	return x
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gonum/floats"
+	"github.com/kshedden/dstream/dstream"
+)
+
+// buildDOCStateCSV generates a small, deterministic dataset of n rows
+// starting at row index start, with two predictors and a Brake
+// response that takes both values, for use across the tests below.
+// Generating rows[start:start+n] of the same sequence used to build a
+// longer run lets a test split that run into pieces (by row range or
+// by chunk) and check the split reassembles to the same statistics.
+func buildDOCStateCSV(start, n int) string {
+	var sb strings.Builder
+	sb.WriteString("x1\tx2\tBrake\n")
+	for i := start; i < start+n; i++ {
+		x1 := float64(i) * 0.37
+		x2 := math.Sin(float64(i))
+		brake := 0.0
+		if i%3 == 0 {
+			brake = 1
+		}
+		fmt.Fprintf(&sb, "%v\t%v\t%v\n", x1, x2, brake)
+	}
+	return sb.String()
+}
+
+func newDOCStateStream(csv string, chunkSize int) dstream.Dstream {
+	return dstream.FromCSV(strings.NewReader(csv)).SetFloatVars([]string{"x1", "x2", "Brake"}).HasHeader().SetChunkSize(chunkSize).Done()
+}
+
+func TestDOCStateSaveLoadRoundTrip(t *testing.T) {
+	xnames := []string{"x1", "x2"}
+	ndir := 1
+
+	ivb := newDOCStateStream(buildDOCStateCSV(0, 20), 5)
+
+	dir, err := os.MkdirTemp("", "docstate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "doc_state.txt")
+
+	st, err := AccumulateDOCState(ivb, "Brake", xnames, ndir, path, nil)
+	if err != nil {
+		t.Fatalf("AccumulateDOCState: %v", err)
+	}
+
+	loaded, err := LoadDOCState(path)
+	if err != nil {
+		t.Fatalf("LoadDOCState: %v", err)
+	}
+
+	if loaded.NObs != st.NObs || loaded.ChunksDone != st.ChunksDone {
+		t.Errorf("NObs/ChunksDone mismatch: got (%d,%d), want (%d,%d)", loaded.NObs, loaded.ChunksDone, st.NObs, st.ChunksDone)
+	}
+	for k := range st.Count {
+		if loaded.Count[k] != st.Count[k] {
+			t.Errorf("Count[%d] mismatch: got %v, want %v", k, loaded.Count[k], st.Count[k])
+		}
+		if !floats.Equal(loaded.Sum[k], st.Sum[k]) {
+			t.Errorf("Sum[%d] mismatch: got %v, want %v", k, loaded.Sum[k], st.Sum[k])
+		}
+		if !floats.Equal(loaded.SumSq[k], st.SumSq[k]) {
+			t.Errorf("SumSq[%d] mismatch: got %v, want %v", k, loaded.SumSq[k], st.SumSq[k])
+		}
+	}
+	if !floats.Equal(loaded.MeanDir(), st.MeanDir()) {
+		t.Errorf("MeanDir mismatch after round trip: got %v, want %v", loaded.MeanDir(), st.MeanDir())
+	}
+	for k := 0; k < ndir; k++ {
+		if !floats.Equal(loaded.CovDir(k), st.CovDir(k)) {
+			t.Errorf("CovDir(%d) mismatch after round trip: got %v, want %v", k, loaded.CovDir(k), st.CovDir(k))
+		}
+	}
+}
+
+// TestAccumulateDOCStateResumeMatchesStraightThrough checks the claim
+// that a fit resumed after a simulated crash is bit-for-bit identical
+// to an uninterrupted one: it accumulates the first half of a stream,
+// checkpoints, resumes over the full stream (skipping the chunks
+// already done), and compares the result to accumulating the full
+// stream in one pass.
+func TestAccumulateDOCStateResumeMatchesStraightThrough(t *testing.T) {
+	xnames := []string{"x1", "x2"}
+	ndir := 1
+	n := 20
+
+	dir, err := os.MkdirTemp("", "docstate-resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	straight, err := AccumulateDOCState(newDOCStateStream(buildDOCStateCSV(0, n), 5), "Brake", xnames, ndir, filepath.Join(dir, "straight.txt"), nil)
+	if err != nil {
+		t.Fatalf("straight-through AccumulateDOCState: %v", err)
+	}
+
+	ckpt, err := AccumulateDOCState(newDOCStateStream(buildDOCStateCSV(0, n/2), 5), "Brake", xnames, ndir, filepath.Join(dir, "partial.txt"), nil)
+	if err != nil {
+		t.Fatalf("partial AccumulateDOCState: %v", err)
+	}
+	if ckpt.ChunksDone == 0 {
+		t.Fatalf("expected the partial run to complete at least one chunk")
+	}
+
+	resumed, err := AccumulateDOCState(newDOCStateStream(buildDOCStateCSV(0, n), 5), "Brake", xnames, ndir, filepath.Join(dir, "resumed.txt"), ckpt)
+	if err != nil {
+		t.Fatalf("resumed AccumulateDOCState: %v", err)
+	}
+
+	if resumed.NObs != straight.NObs {
+		t.Errorf("NObs mismatch: resumed=%d, straight=%d", resumed.NObs, straight.NObs)
+	}
+	for k := range straight.Count {
+		if resumed.Count[k] != straight.Count[k] {
+			t.Errorf("Count[%d] mismatch: resumed=%v, straight=%v", k, resumed.Count[k], straight.Count[k])
+		}
+		if !floats.Equal(resumed.Sum[k], straight.Sum[k]) {
+			t.Errorf("Sum[%d] mismatch: resumed=%v, straight=%v", k, resumed.Sum[k], straight.Sum[k])
+		}
+		if !floats.Equal(resumed.SumSq[k], straight.SumSq[k]) {
+			t.Errorf("SumSq[%d] mismatch: resumed=%v, straight=%v", k, resumed.SumSq[k], straight.SumSq[k])
+		}
+	}
+	if !floats.Equal(resumed.MeanDir(), straight.MeanDir()) {
+		t.Errorf("MeanDir mismatch: resumed=%v, straight=%v", resumed.MeanDir(), straight.MeanDir())
+	}
+	for k := 0; k < ndir; k++ {
+		if !floats.Equal(resumed.CovDir(k), straight.CovDir(k)) {
+			t.Errorf("CovDir(%d) mismatch: resumed=%v, straight=%v", k, resumed.CovDir(k), straight.CovDir(k))
+		}
+	}
+}
+
+// TestMergeDOCState checks that merging two partial accumulations
+// (as if accumulated from separate input files) reproduces the same
+// statistics as accumulating their concatenation in one pass, and
+// that the merged state is marked unresumable.
+func TestMergeDOCState(t *testing.T) {
+	xnames := []string{"x1", "x2"}
+	ndir := 1
+
+	dir, err := os.MkdirTemp("", "docstate-merge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stA, err := AccumulateDOCState(newDOCStateStream(buildDOCStateCSV(0, 10), 5), "Brake", xnames, ndir, filepath.Join(dir, "a.txt"), nil)
+	if err != nil {
+		t.Fatalf("accumulate A: %v", err)
+	}
+	stB, err := AccumulateDOCState(newDOCStateStream(buildDOCStateCSV(10, 10), 5), "Brake", xnames, ndir, filepath.Join(dir, "b.txt"), nil)
+	if err != nil {
+		t.Fatalf("accumulate B: %v", err)
+	}
+
+	merged, err := MergeDOCState(stA, stB)
+	if err != nil {
+		t.Fatalf("MergeDOCState: %v", err)
+	}
+	if merged.ChunksDone != -1 {
+		t.Errorf("merged.ChunksDone = %d, want -1 (not resumable)", merged.ChunksDone)
+	}
+
+	straight, err := AccumulateDOCState(newDOCStateStream(buildDOCStateCSV(0, 20), 5), "Brake", xnames, ndir, filepath.Join(dir, "full.txt"), nil)
+	if err != nil {
+		t.Fatalf("accumulate full: %v", err)
+	}
+
+	if merged.NObs != straight.NObs {
+		t.Errorf("NObs mismatch: merged=%d, straight=%d", merged.NObs, straight.NObs)
+	}
+	for k := range straight.Count {
+		if merged.Count[k] != straight.Count[k] {
+			t.Errorf("Count[%d] mismatch: merged=%v, straight=%v", k, merged.Count[k], straight.Count[k])
+		}
+		if !floats.Equal(merged.Sum[k], straight.Sum[k]) {
+			t.Errorf("Sum[%d] mismatch: merged=%v, straight=%v", k, merged.Sum[k], straight.Sum[k])
+		}
+		if !floats.Equal(merged.SumSq[k], straight.SumSq[k]) {
+			t.Errorf("SumSq[%d] mismatch: merged=%v, straight=%v", k, merged.SumSq[k], straight.SumSq[k])
+		}
+	}
+	if !floats.Equal(merged.MeanDir(), straight.MeanDir()) {
+		t.Errorf("MeanDir mismatch: merged=%v, straight=%v", merged.MeanDir(), straight.MeanDir())
+	}
+
+	if _, err := AccumulateDOCState(newDOCStateStream(buildDOCStateCSV(0, 20), 5), "Brake", xnames, ndir, filepath.Join(dir, "resume-merged.txt"), merged); err == nil {
+		t.Errorf("AccumulateDOCState should reject resuming from a merged DOCState")
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kshedden/dstream/dstream"
+)
+
+// LagLayout describes one lagged variable group in the manifest, so
+// that downstream scripts can reconstruct the column -> (name, lag)
+// mapping used when the tables were written.
+type LagLayout struct {
+	Name   string `json:"name"`
+	MinLag int    `json:"min_lag"`
+	MaxLag int    `json:"max_lag"`
+}
+
+// Manifest describes the layout of the tables written by
+// WriteDOCTables, so that R/Python/Julia scripts can reproduce the
+// plots in this package without re-running the fit.
+type Manifest struct {
+	NDir   int         `json:"ndir"`
+	NObs   int         `json:"nobs"`
+	Layout []LagLayout `json:"layout"`
+}
+
+// WriteDOCTables writes all of doc's fitted outputs (YMean, YCov,
+// MeanDir, CovDir) and the projected scores (dr0, dr1, dr2 alongside
+// Brake) to plain tab-separated tables under outdir, along with a
+// manifest.json describing the lag layout of the variables.  ivb is
+// the dstream that dr0..dr(ndir) and Brake were projected onto (the
+// same stream passed to Linapply in main), and xnames is ivr.XNames().
+func WriteDOCTables(doc docFit, ivb dstream.Dstream, xnames []string, ndir int, outdir string) error {
+
+	if err := os.MkdirAll(outdir, 0755); err != nil {
+		return err
+	}
+
+	names := xnames
+
+	if err := writeTable(filepath.Join(outdir, "ymean.tsv"), names, [][]float64{doc.YMean(0), doc.YMean(1)}, []string{"noBrake", "Brake"}); err != nil {
+		return err
+	}
+
+	for k := 0; k < 2; k++ {
+		fname := filepath.Join(outdir, fmt.Sprintf("ycov%d.tsv", k))
+		if err := writeSquareTable(fname, names, doc.YCov(k)); err != nil {
+			return err
+		}
+	}
+
+	dirCols := [][]float64{doc.MeanDir()}
+	dirNames := []string{"MeanDir"}
+	for k := 0; k < ndir; k++ {
+		dirCols = append(dirCols, doc.CovDir(k))
+		dirNames = append(dirNames, fmt.Sprintf("CovDir%d", k))
+	}
+	if err := writeTable(filepath.Join(outdir, "mean_dir.tsv"), names, dirCols, dirNames); err != nil {
+		return err
+	}
+
+	if err := writeScoreTable(filepath.Join(outdir, "scores.tsv"), ivb, ndir); err != nil {
+		return err
+	}
+
+	manifest := Manifest{
+		NDir: ndir,
+		NObs: ivb.NumObs(),
+		Layout: []LagLayout{
+			{Name: "Speed", MinLag: -maxSpeedLag, MaxLag: 0},
+			{Name: "FcwRange", MinLag: -maxRangeLag, MaxLag: 0},
+		},
+	}
+	mf, err := os.Create(filepath.Join(outdir, "manifest.json"))
+	if err != nil {
+		return err
+	}
+	defer mf.Close()
+	enc := json.NewEncoder(mf)
+	enc.SetIndent("", "  ")
+	return enc.Encode(manifest)
+}
+
+// writeTable writes a set of named column vectors, each indexed by
+// varNames (a variable-name header column followed by one column per
+// entry in colNames), to a tab-separated file.
+func writeTable(path string, varNames []string, cols [][]float64, colNames []string) error {
+
+	fid, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+
+	w := bufio.NewWriter(fid)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "Variable")
+	for _, c := range colNames {
+		fmt.Fprintf(w, "\t%s", c)
+	}
+	fmt.Fprintf(w, "\n")
+
+	for i, vn := range varNames {
+		fmt.Fprintf(w, "%s", vn)
+		for _, col := range cols {
+			fmt.Fprintf(w, "\t%v", col[i])
+		}
+		fmt.Fprintf(w, "\n")
+	}
+
+	return nil
+}
+
+// writeSquareTable writes a p x p row-major matrix (as produced by
+// doc.YCov) with both row and column headers set to varNames.
+func writeSquareTable(path string, varNames []string, mat []float64) error {
+
+	fid, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+
+	w := bufio.NewWriter(fid)
+	defer w.Flush()
+
+	p := len(varNames)
+
+	fmt.Fprintf(w, "Variable")
+	for _, vn := range varNames {
+		fmt.Fprintf(w, "\t%s", vn)
+	}
+	fmt.Fprintf(w, "\n")
+
+	for i := 0; i < p; i++ {
+		fmt.Fprintf(w, "%s", varNames[i])
+		for j := 0; j < p; j++ {
+			fmt.Fprintf(w, "\t%v", mat[i*p+j])
+		}
+		fmt.Fprintf(w, "\n")
+	}
+
+	return nil
+}
+
+// writeScoreTable writes the Brake response alongside every one of
+// the projected scores dr0/dr1/.../dr(ndir), one row per observation.
+// Each of those scores is read from data as a column; none is skipped.
+func writeScoreTable(path string, data dstream.Dstream, ndir int) error {
+
+	fid, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer fid.Close()
+
+	w := bufio.NewWriter(fid)
+	defer w.Flush()
+
+	var scoreNames []string
+	for k := 0; k <= ndir; k++ {
+		scoreNames = append(scoreNames, fmt.Sprintf("dr%d", k))
+	}
+
+	fmt.Fprintf(w, "Brake")
+	for _, sn := range scoreNames {
+		fmt.Fprintf(w, "\t%s", sn)
+	}
+	fmt.Fprintf(w, "\n")
+
+	data.Reset()
+	brake := dstream.GetCol(data, "Brake").([]float64)
+	cols := make([][]float64, len(scoreNames))
+	for i, sn := range scoreNames {
+		data.Reset()
+		cols[i] = dstream.GetCol(data, sn).([]float64)
+	}
+
+	for i := range brake {
+		fmt.Fprintf(w, "%v", brake[i])
+		for _, c := range cols {
+			fmt.Fprintf(w, "\t%v", c[i])
+		}
+		fmt.Fprintf(w, "\n")
+	}
+
+	return nil
+}
+
+// DOCTables holds the round-tripped contents of the tables written by
+// WriteDOCTables, for use in tests and downstream Go tooling.
+type DOCTables struct {
+	VarNames []string
+	YMean    [][]float64 // [class][variable]
+	YCov     [][]float64 // [class][p*p, row-major]
+	MeanDir  []float64
+	CovDir   [][]float64
+	Manifest Manifest
+}
+
+// ReadDOCTables reads back the tables and manifest written by
+// WriteDOCTables from outdir.
+func ReadDOCTables(outdir string) (*DOCTables, error) {
+
+	mf, err := os.Open(filepath.Join(outdir, "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+	defer mf.Close()
+	var manifest Manifest
+	if err := json.NewDecoder(mf).Decode(&manifest); err != nil {
+		return nil, err
+	}
+
+	varNames, meanCols, err := readTable(filepath.Join(outdir, "ymean.tsv"))
+	if err != nil {
+		return nil, err
+	}
+
+	ycov := make([][]float64, 2)
+	for k := 0; k < 2; k++ {
+		_, mat, err := readTable(filepath.Join(outdir, fmt.Sprintf("ycov%d.tsv", k)))
+		if err != nil {
+			return nil, err
+		}
+		// readTable returns mat column-major (mat[j][i] is the
+		// value at table row i, column j), but writeSquareTable
+		// wrote YCov row-major (YCov[i*p+j] at row i, column j), so
+		// flattening mat directly would silently transpose it.
+		p := len(mat)
+		flat := make([]float64, p*p)
+		for i := 0; i < p; i++ {
+			for j := 0; j < p; j++ {
+				flat[i*p+j] = mat[j][i]
+			}
+		}
+		ycov[k] = flat
+	}
+
+	_, dirCols, err := readTable(filepath.Join(outdir, "mean_dir.tsv"))
+	if err != nil {
+		return nil, err
+	}
+
+	t := &DOCTables{
+		VarNames: varNames,
+		YMean:    meanCols,
+		YCov:     ycov,
+		Manifest: manifest,
+	}
+	if len(dirCols) > 0 {
+		t.MeanDir = dirCols[0]
+		t.CovDir = dirCols[1:]
+	}
+
+	return t, nil
+}
+
+// readTable reads a tab-separated table with a header row and a
+// leading "Variable" name column, back into a row name slice and a
+// list of columns (one []float64 per data column, indexed the same
+// way as the row names).
+func readTable(path string) ([]string, [][]float64, error) {
+
+	fid, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fid.Close()
+
+	scanner := bufio.NewScanner(fid)
+	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
+
+	var names []string
+	var rows [][]float64
+
+	first := true
+	var ncol int
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if first {
+			ncol = len(fields) - 1
+			first = false
+			continue
+		}
+		names = append(names, fields[0])
+		row := make([]float64, ncol)
+		for j := 0; j < ncol; j++ {
+			row[j], _ = strconv.ParseFloat(fields[j+1], 64)
+		}
+		rows = append(rows, row)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	cols := make([][]float64, ncol)
+	for j := 0; j < ncol; j++ {
+		cols[j] = make([]float64, len(rows))
+		for i, row := range rows {
+			cols[j][i] = row[j]
+		}
+	}
+
+	return names, cols, nil
+}
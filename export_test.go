@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gonum/floats"
+	"github.com/kshedden/dstream/dstream"
+)
+
+// fakeDOC is a minimal docFit used only to drive WriteDOCTables/
+// ReadDOCTables round-trip tests, without needing a real fit.
+type fakeDOC struct {
+	ymean   [][]float64
+	ycov    [][]float64
+	meanDir []float64
+	covDir  [][]float64
+}
+
+func (f *fakeDOC) YMean(k int) []float64  { return f.ymean[k] }
+func (f *fakeDOC) YCov(k int) []float64   { return f.ycov[k] }
+func (f *fakeDOC) MeanDir() []float64     { return f.meanDir }
+func (f *fakeDOC) CovDir(k int) []float64 { return f.covDir[k] }
+
+// TestWriteReadDOCTablesRoundTrip round-trips WriteDOCTables through
+// ReadDOCTables and checks that YMean, YCov, MeanDir, CovDir and the
+// manifest's NDir come back unchanged.  YCov is
+// deliberately asymmetric, since a row/column transpose bug in
+// ReadDOCTables is invisible for a symmetric matrix.
+func TestWriteReadDOCTablesRoundTrip(t *testing.T) {
+	xnames := []string{"Speed[-1]", "Speed[0]", "FcwRange[0]"}
+	ndir := 2
+
+	ycov0 := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9}
+	ycov1 := []float64{9, 8, 7, 6, 5, 4, 3, 2, 1}
+	doc := &fakeDOC{
+		ymean:   [][]float64{{1, 2, 3}, {4, 5, 6}},
+		ycov:    [][]float64{ycov0, ycov1},
+		meanDir: []float64{0.1, 0.2, 0.3},
+		covDir:  [][]float64{{0.4, 0.5, 0.6}, {0.7, 0.8, 0.9}},
+	}
+
+	csv := "dr0\tdr1\tdr2\tBrake\n0.1\t0.2\t0.3\t0\n0.4\t0.5\t0.6\t1\n"
+	ivb := dstream.FromCSV(strings.NewReader(csv)).SetFloatVars([]string{"dr0", "dr1", "dr2", "Brake"}).HasHeader().SetChunkSize(10).Done()
+
+	outdir, err := os.MkdirTemp("", "doctables")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outdir)
+
+	if err := WriteDOCTables(doc, ivb, xnames, ndir, outdir); err != nil {
+		t.Fatalf("WriteDOCTables: %v", err)
+	}
+
+	got, err := ReadDOCTables(outdir)
+	if err != nil {
+		t.Fatalf("ReadDOCTables: %v", err)
+	}
+
+	if !floats.Equal(got.YMean[0], doc.ymean[0]) || !floats.Equal(got.YMean[1], doc.ymean[1]) {
+		t.Errorf("YMean round-trip mismatch: got %v, want %v", got.YMean, doc.ymean)
+	}
+	if !floats.Equal(got.YCov[0], ycov0) {
+		t.Errorf("YCov[0] round-trip mismatch: got %v, want %v", got.YCov[0], ycov0)
+	}
+	if !floats.Equal(got.YCov[1], ycov1) {
+		t.Errorf("YCov[1] round-trip mismatch: got %v, want %v", got.YCov[1], ycov1)
+	}
+	if !floats.Equal(got.MeanDir, doc.meanDir) {
+		t.Errorf("MeanDir round-trip mismatch: got %v, want %v", got.MeanDir, doc.meanDir)
+	}
+	if len(got.CovDir) != ndir {
+		t.Fatalf("CovDir round-trip length mismatch: got %d, want %d", len(got.CovDir), ndir)
+	}
+	for k := range doc.covDir {
+		if !floats.Equal(got.CovDir[k], doc.covDir[k]) {
+			t.Errorf("CovDir[%d] round-trip mismatch: got %v, want %v", k, got.CovDir[k], doc.covDir[k])
+		}
+	}
+	if got.Manifest.NDir != ndir {
+		t.Errorf("Manifest.NDir = %d, want %d", got.Manifest.NDir, ndir)
+	}
+}
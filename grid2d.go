@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/gonum/floats"
+	"github.com/gonum/plot/palette"
+	"github.com/gonum/plot/plotter"
+	"github.com/kshedden/dstream/dstream"
+)
+
+// GridMode selects how NewAdaptiveGrid chooses bin boundaries.
+type GridMode int
+
+const (
+	// EqualWidth divides the observed range of each axis into
+	// bins of equal width.
+	EqualWidth GridMode = iota
+	// EqualFrequency divides each axis into bins holding (as
+	// close as possible to) equal numbers of observations, i.e.
+	// quantile bins.
+	EqualFrequency
+	// Breakpoints uses caller-supplied bin edges, set via
+	// NewGridFromBreaks rather than NewAdaptiveGrid.
+	Breakpoints
+)
+
+// Grid2D is a 2D histogram grid over a pair of projected variables
+// (e.g. dr0 vs dr1, or Speed[0] vs FcwRange[0]).  It generalizes the
+// hard-coded 100x100 grid and magic linear transform that used to
+// live directly in getCells/heatMap/cellMeans.
+type Grid2D struct {
+	Mode GridMode
+
+	// RowBreaks and ColBreaks hold nrow+1 and ncol+1 bin edges
+	// respectively, in ascending order.
+	RowBreaks []float64
+	ColBreaks []float64
+
+	// MinCount is the cell-count threshold: a cell is considered
+	// estimable only when it contains more than MinCount
+	// observations; cells at or below it are reported as missing
+	// rather than noisy.
+	MinCount int
+}
+
+// NewAdaptiveGrid builds a Grid2D over x0 (rows) and x1 (columns)
+// with nrow x ncol cells, using either equal-width or equal-frequency
+// (quantile) binning.  Use NewGridFromBreaks for caller-specified
+// breakpoints.
+func NewAdaptiveGrid(x0, x1 []float64, nrow, ncol int, mode GridMode) *Grid2D {
+
+	g := &Grid2D{Mode: mode, MinCount: minCount}
+
+	switch mode {
+	case EqualFrequency:
+		g.RowBreaks = quantileBreaks(x0, nrow)
+		g.ColBreaks = quantileBreaks(x1, ncol)
+	default:
+		g.RowBreaks = equalWidthBreaks(x0, nrow)
+		g.ColBreaks = equalWidthBreaks(x1, ncol)
+	}
+
+	return g
+}
+
+// NewGridFromBreaks builds a Grid2D from explicit, ascending bin
+// edges (length nrow+1 and ncol+1) supplied by the caller.
+func NewGridFromBreaks(rowBreaks, colBreaks []float64) *Grid2D {
+	return &Grid2D{Mode: Breakpoints, RowBreaks: rowBreaks, ColBreaks: colBreaks, MinCount: minCount}
+}
+
+// Nrow returns the number of row bins.
+func (g *Grid2D) Nrow() int { return len(g.RowBreaks) - 1 }
+
+// Ncol returns the number of column bins.
+func (g *Grid2D) Ncol() int { return len(g.ColBreaks) - 1 }
+
+func equalWidthBreaks(x []float64, n int) []float64 {
+	lo, hi := floats.Min(x), floats.Max(x)
+	breaks := make([]float64, n+1)
+	for i := range breaks {
+		breaks[i] = lo + (hi-lo)*float64(i)/float64(n)
+	}
+	return breaks
+}
+
+func quantileBreaks(x []float64, n int) []float64 {
+	sorted := make([]float64, len(x))
+	copy(sorted, x)
+	sort.Float64s(sorted)
+
+	breaks := make([]float64, n+1)
+	for i := range breaks {
+		breaks[i] = quantile(sorted, float64(i)/float64(n))
+	}
+	return breaks
+}
+
+// bin returns the index of the bin containing v given ascending bin
+// edges, or -1 if v falls outside [edges[0], edges[len(edges)-1]].
+func bin(edges []float64, v float64) int {
+	if v < edges[0] || v > edges[len(edges)-1] {
+		return -1
+	}
+	i := sort.SearchFloat64s(edges, v)
+	if i > 0 && (i == len(edges) || edges[i] != v) {
+		i--
+	}
+	if i >= len(edges)-1 {
+		i = len(edges) - 2
+	}
+	return i
+}
+
+// Assign buckets each (x0[i], x1[i]) pair into a (row, col) cell
+// index; entries outside the grid get row=-1 or col=-1.
+func (g *Grid2D) Assign(x0, x1 []float64) (row, col []int) {
+	row = make([]int, len(x0))
+	col = make([]int, len(x1))
+	for i := range x0 {
+		row[i] = bin(g.RowBreaks, x0[i])
+		col[i] = bin(g.ColBreaks, x1[i])
+	}
+	return row, col
+}
+
+// CellMeans computes, for each grid cell, the mean of every column in
+// cols (positions into data, resolved once per chunk via GetPos) over
+// the observations falling in that cell, along with the per-cell
+// observation counts.  row and col are as returned by Assign.
+func (g *Grid2D) CellMeans(data dstream.Dstream, cols []int, row, col []int) ([][]float64, []int) {
+
+	nrow, ncol := g.Nrow(), g.Ncol()
+	cmn := make([][]float64, nrow*ncol)
+	cmc := make([]int, nrow*ncol)
+	for i := range cmn {
+		cmn[i] = make([]float64, len(cols))
+	}
+
+	data.Reset()
+	ii := 0
+	for data.Next() {
+		var n int
+		for j, k := range cols {
+			v := data.GetPos(k).([]float64)
+			n = len(v)
+			for i := 0; i < len(v); i++ {
+				jj := ii + i
+				if row[jj] >= 0 && row[jj] < nrow && col[jj] >= 0 && col[jj] < ncol {
+					q := row[jj]*ncol + col[jj]
+					cmn[q][j] += v[i]
+					if j == 0 {
+						cmc[q]++
+					}
+				}
+			}
+		}
+		ii += n
+	}
+
+	for q, v := range cmn {
+		if cmc[q] > 0 {
+			floats.Scale(1/float64(cmc[q]), v)
+		}
+	}
+
+	return cmn, cmc
+}
+
+// StandardizeCellMeans centers and scales each column of cmn to have
+// mean zero and variance one, across all cells weighted by their
+// observation counts cmc.
+func (g *Grid2D) StandardizeCellMeans(cmn [][]float64, cmc []int) {
+
+	v := make([]float64, len(cmn[0]))
+
+	w := 0
+	for i, u := range cmn {
+		if cmc[i] > 0 {
+			floats.AddScaled(v, float64(cmc[i]), u)
+			w += cmc[i]
+		}
+	}
+	floats.Scale(1/float64(w), v)
+	for i, u := range cmn {
+		if cmc[i] > 0 {
+			floats.Sub(u, v)
+		}
+	}
+
+	for j := range v {
+		v[j] = 0
+	}
+	w = 0
+	for i, u := range cmn {
+		if cmc[i] > 0 {
+			for j, x := range u {
+				v[j] += float64(cmc[i]) * x * x
+			}
+			w += cmc[i]
+		}
+	}
+	floats.Scale(1/float64(w), v)
+	for j, x := range v {
+		v[j] = math.Sqrt(x)
+	}
+	for i, u := range cmn {
+		if cmc[i] > 0 {
+			for j, x := range u {
+				u[j] = x / v[j]
+			}
+		}
+	}
+}
+
+// HeatMap computes, for each grid cell, the fraction of observations
+// with y == 1 (raised to the 0.1 power to compress the dynamic range
+// for plotting), with cells holding MinCount or fewer observations
+// reported as -1 (missing).
+func (g *Grid2D) HeatMap(y, x0, x1 []float64) ([]float64, []int) {
+
+	nrow, ncol := g.Nrow(), g.Ncol()
+	row, col := g.Assign(x0, x1)
+
+	missed := 0
+	hit := 0
+	num := make([]float64, nrow*ncol)
+	denom := make([]int, nrow*ncol)
+	for i := range x0 {
+		if row[i] >= 0 && col[i] >= 0 && row[i] < nrow && col[i] < ncol {
+			denom[ncol*row[i]+col[i]]++
+			if y[i] == 1 {
+				num[ncol*row[i]+col[i]]++
+			}
+			hit++
+		} else {
+			missed++
+		}
+	}
+	fmt.Printf("Missed %d\n", missed)
+	fmt.Printf("Hit %d\n", hit)
+
+	rat := make([]float64, nrow*ncol)
+	for i := range num {
+		if denom[i] > g.MinCount {
+			rat[i] = math.Pow(num[i]/float64(denom[i]), 0.1)
+		} else {
+			rat[i] = -1
+		}
+	}
+
+	return rat, denom
+}
+
+// gridxyz adapts a Grid2D cell value array to the XYZGrid interface
+// expected by plotter.NewHeatMap and plotter.NewContour.
+type gridxyz struct {
+	g    *Grid2D
+	data []float64
+}
+
+func (m *gridxyz) Dims() (int, int) {
+	return m.g.Ncol(), m.g.Nrow()
+}
+
+func (m *gridxyz) Z(c, r int) float64 {
+	return m.data[r*m.g.Ncol()+c]
+}
+
+func (m *gridxyz) X(c int) float64 {
+	return 0.5 * (m.g.ColBreaks[c] + m.g.ColBreaks[c+1])
+}
+
+func (m *gridxyz) Y(r int) float64 {
+	return 0.5 * (m.g.RowBreaks[r] + m.g.RowBreaks[r+1])
+}
+
+// Min and Max scale the heat-map/contour palette, so they must ignore
+// the -1 sentinel HeatMap uses for cells at or below MinCount -- including
+// it would stretch the palette down to -1 and crush the real [0, 1]
+// range of P(Brake) into a sliver of the color scale, and would draw
+// spurious contour rings around every missing cell.
+func (m *gridxyz) Min() float64 {
+	min := math.Inf(1)
+	for _, v := range m.data {
+		if v >= 0 && v < min {
+			min = v
+		}
+	}
+	if math.IsInf(min, 1) {
+		return 0
+	}
+	return min
+}
+
+func (m *gridxyz) Max() float64 {
+	max := math.Inf(-1)
+	for _, v := range m.data {
+		if v >= 0 && v > max {
+			max = v
+		}
+	}
+	if math.IsInf(max, -1) {
+		return 0
+	}
+	return max
+}
+
+// PlotHeatMap renders data (as produced by HeatMap or CellMeans) as a
+// plotter.HeatMap image.
+func (g *Grid2D) PlotHeatMap(data []float64, pc plotconfig, fname string) error {
+
+	pal := palette.Heat(100, 1)
+	h := plotter.NewHeatMap(&gridxyz{g: g, data: data}, pal)
+
+	p, err := newPlot(pc)
+	if err != nil {
+		return err
+	}
+	p.Add(h)
+
+	return savePlot(p, fname)
+}
+
+// PlotContour renders data as a contour plot instead of a filled
+// heat map, using the given contour levels.
+func (g *Grid2D) PlotContour(data []float64, levels []float64, pc plotconfig, fname string) error {
+
+	pal := palette.Heat(100, 1)
+	c := plotter.NewContour(&gridxyz{g: g, data: data}, levels, pal)
+
+	p, err := newPlot(pc)
+	if err != nil {
+		return err
+	}
+	p.Add(c)
+
+	return savePlot(p, fname)
+}
@@ -0,0 +1,251 @@
+package main
+
+import "math"
+
+// Kernel is a symmetric weighting kernel used by SmoothBrakeProb.
+type Kernel int
+
+const (
+	// Gaussian is the standard normal density kernel.
+	Gaussian Kernel = iota
+	// Epanechnikov is the compact-support quadratic kernel, zero
+	// outside [-1, 1].
+	Epanechnikov
+)
+
+func (k Kernel) weight(u float64) float64 {
+	switch k {
+	case Epanechnikov:
+		if math.Abs(u) >= 1 {
+			return 0
+		}
+		return 0.75 * (1 - u*u)
+	default:
+		return math.Exp(-0.5*u*u) / math.Sqrt(2*math.Pi)
+	}
+}
+
+// Method selects the local regression estimator used by
+// SmoothBrakeProb.
+type Method int
+
+const (
+	// NadarayaWatson is plain kernel-weighted local averaging.
+	NadarayaWatson Method = iota
+	// LocalLinear fits a local line at each query point, which
+	// reduces the boundary bias that NadarayaWatson (and the
+	// boxcar estimator it replaces) suffers from at the edges of
+	// the score range.
+	LocalLinear
+)
+
+// SmoothOptions configures SmoothBrakeProb.
+type SmoothOptions struct {
+	Kernel Kernel
+	Method Method
+
+	// Bandwidth is the kernel bandwidth.  If zero, it is chosen
+	// by BandwidthCV (leave-one-out cross-validation).
+	Bandwidth float64
+
+	// NQuery is the number of evenly-spaced query points spanning
+	// the range of sc at which to evaluate the fit.  If zero or
+	// negative, queryGrid defaults it to 100.
+	NQuery int
+}
+
+// SmoothBrakeProb estimates P(Brake=1 | score=x) over a grid of
+// query points x, using either Nadaraya-Watson kernel regression or
+// local linear regression, replacing the fixed-window boxcar used by
+// getBrakeProb.  It returns pointwise standard errors alongside the
+// estimate, computed from the sandwich formula for a weighted least
+// squares fit.
+func SmoothBrakeProb(sc, br []float64, opts SmoothOptions) (x, phat, se []float64) {
+
+	h := opts.Bandwidth
+	if h <= 0 {
+		h = BandwidthCV(sc, br, opts.Kernel, opts.Method)
+	}
+
+	x = queryGrid(sc, opts.NQuery)
+	phat = make([]float64, len(x))
+	se = make([]float64, len(x))
+
+	for i, x0 := range x {
+		switch opts.Method {
+		case LocalLinear:
+			phat[i], se[i] = localLinearFit(sc, br, x0, h, opts.Kernel)
+		default:
+			phat[i], se[i] = nadarayaWatsonFit(sc, br, x0, h, opts.Kernel)
+		}
+	}
+
+	return x, phat, se
+}
+
+func queryGrid(sc []float64, n int) []float64 {
+	if n <= 0 {
+		n = 100
+	}
+	lo, hi := sc[0], sc[0]
+	for _, v := range sc {
+		if v < lo {
+			lo = v
+		}
+		if v > hi {
+			hi = v
+		}
+	}
+	x := make([]float64, n)
+	for i := range x {
+		x[i] = lo + (hi-lo)*float64(i)/float64(n-1)
+	}
+	return x
+}
+
+// nadarayaWatsonFit solves the kernel-weighted mean of br at x0,
+// i.e. a locally constant (intercept-only) weighted least squares
+// fit, and returns its standard error from the sandwich formula
+// Var(ahat) = (sum w_i^2 * e_i^2) / (sum w_i)^2 where e_i are the
+// working residuals.
+func nadarayaWatsonFit(sc, br []float64, x0, h float64, kern Kernel) (a, se float64) {
+
+	var sw, swy float64
+	w := make([]float64, len(sc))
+	for i, s := range sc {
+		w[i] = kern.weight((s - x0) / h)
+		sw += w[i]
+		swy += w[i] * br[i]
+	}
+	if sw == 0 {
+		return 0, 0
+	}
+	a = swy / sw
+
+	var swe2, sw2 float64
+	for i := range sc {
+		e := br[i] - a
+		swe2 += w[i] * w[i] * e * e
+		sw2 += w[i]
+	}
+	se = math.Sqrt(swe2) / sw2
+
+	return a, se
+}
+
+// localLinearFit solves the weighted least squares problem
+//
+//	minimize sum_i K_h(sc_i - x0) * (br_i - a - b*(sc_i - x0))^2
+//
+// for (a, b), returning a as the estimate of P(Brake=1 | score=x0)
+// and its standard error from the sandwich formula for weighted
+// least squares, Var(ahat) = e1' (X'WX)^-1 X'WEWX (X'WX)^-1 e1, where
+// e1 = (1, 0)' and E = diag(e_i^2) holds the squared fitted residuals.
+func localLinearFit(sc, br []float64, x0, h float64, kern Kernel) (a, se float64) {
+
+	// Weighted design matrix moments for the 2-parameter local
+	// linear model, accumulated directly since p=2 here.
+	var s0, s1, s2, t0, t1 float64
+	for i, s := range sc {
+		u := s - x0
+		w := kern.weight(u / h)
+		s0 += w
+		s1 += w * u
+		s2 += w * u * u
+		t0 += w * br[i]
+		t1 += w * u * br[i]
+	}
+
+	det := s0*s2 - s1*s1
+	if det == 0 {
+		return nadarayaWatsonFit(sc, br, x0, h, kern)
+	}
+
+	// (X'WX)^-1, 2x2 symmetric.
+	i00 := s2 / det
+	i01 := -s1 / det
+	i11 := s0 / det
+
+	a = i00*t0 + i01*t1
+
+	// Row 1 of (X'WX)^-1 X'W is the effective weight c_i applied
+	// to br_i in computing a; the sandwich variance is
+	// sum(c_i^2 * e_i^2) where e_i are the fitted residuals.
+	bb := i01*t0 + i11*t1
+	var sve float64
+	for i, s := range sc {
+		u := s - x0
+		w := kern.weight(u / h)
+		c := w * (i00 + i01*u)
+		e := br[i] - a - bb*u
+		sve += c * c * e * e
+	}
+	se = math.Sqrt(sve)
+
+	return a, se
+}
+
+// BandwidthCV chooses a bandwidth for sc/br by leave-one-out cross
+// validation, minimizing the squared prediction error of the given
+// kernel and method over a fixed grid of candidate bandwidths, from
+// 0.5% to 30% of the range of sc.  Leave-one-out scoring is
+// O(n^2) per candidate bandwidth, so for large inputs it is computed
+// on an evenly-strided subsample rather than the full data set.
+func BandwidthCV(sc, br []float64, kern Kernel, method Method) float64 {
+
+	const maxCVPoints = 2000
+	if len(sc) > maxCVPoints {
+		sub := make([]int, maxCVPoints)
+		for i := range sub {
+			sub[i] = i * len(sc) / maxCVPoints
+		}
+		scs := make([]float64, maxCVPoints)
+		brs := make([]float64, maxCVPoints)
+		for i, j := range sub {
+			scs[i] = sc[j]
+			brs[i] = br[j]
+		}
+		sc, br = scs, brs
+	}
+
+	lo, hi := sc[0], sc[0]
+	for _, v := range sc {
+		if v < lo {
+			lo = v
+		}
+		if v > hi {
+			hi = v
+		}
+	}
+	span := hi - lo
+	if span == 0 {
+		return 1
+	}
+
+	best := span / 10
+	bestErr := math.Inf(1)
+
+	for _, frac := range []float64{0.005, 0.01, 0.02, 0.05, 0.1, 0.2, 0.3} {
+		h := span * frac
+		errSum := 0.0
+		for i := range sc {
+			scLoo := append(append([]float64{}, sc[:i]...), sc[i+1:]...)
+			brLoo := append(append([]float64{}, br[:i]...), br[i+1:]...)
+
+			var pred float64
+			if method == LocalLinear {
+				pred, _ = localLinearFit(scLoo, brLoo, sc[i], h, kern)
+			} else {
+				pred, _ = nadarayaWatsonFit(scLoo, brLoo, sc[i], h, kern)
+			}
+			d := br[i] - pred
+			errSum += d * d
+		}
+		if errSum < bestErr {
+			bestErr = errSum
+			best = h
+		}
+	}
+
+	return best
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// TestSmoothBrakeProbStep checks that SmoothBrakeProb recovers a sharp
+// step in P(Brake=1 | score) at roughly the right location, with
+// output slices all the same length and phat bounded near [0, 1].
+func TestSmoothBrakeProbStep(t *testing.T) {
+	n := 400
+	sc := make([]float64, n)
+	br := make([]float64, n)
+	for i := 0; i < n; i++ {
+		sc[i] = float64(i) / float64(n-1)
+		if sc[i] > 0.5 {
+			br[i] = 1
+		}
+	}
+
+	opts := SmoothOptions{Kernel: Gaussian, Method: LocalLinear, Bandwidth: 0.05}
+	x, phat, se := SmoothBrakeProb(sc, br, opts)
+
+	if len(x) != len(phat) || len(phat) != len(se) {
+		t.Fatalf("mismatched output lengths: len(x)=%d len(phat)=%d len(se)=%d", len(x), len(phat), len(se))
+	}
+	for i, p := range phat {
+		if p < -1e-6 || p > 1+1e-6 {
+			t.Errorf("phat[%d]=%v at x=%v outside [0,1]", i, p, x[i])
+		}
+	}
+
+	lowIdx := int(0.1 * float64(len(x)-1))
+	highIdx := int(0.9 * float64(len(x)-1))
+	if phat[lowIdx] > 0.2 {
+		t.Errorf("phat near x=%v = %v, expected close to 0", x[lowIdx], phat[lowIdx])
+	}
+	if phat[highIdx] < 0.8 {
+		t.Errorf("phat near x=%v = %v, expected close to 1", x[highIdx], phat[highIdx])
+	}
+}
+
+// TestBandwidthCVPositive checks that BandwidthCV returns a positive
+// bandwidth on noisy binary response data for both supported methods.
+func TestBandwidthCVPositive(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	n := 300
+	sc := make([]float64, n)
+	br := make([]float64, n)
+	for i := range sc {
+		sc[i] = rng.Float64() * 10
+		p := 1 / (1 + math.Exp(-(sc[i] - 5)))
+		if rng.Float64() < p {
+			br[i] = 1
+		}
+	}
+
+	for _, method := range []Method{NadarayaWatson, LocalLinear} {
+		h := BandwidthCV(sc, br, Gaussian, method)
+		if h <= 0 {
+			t.Errorf("BandwidthCV(method=%v) returned non-positive bandwidth %v", method, h)
+		}
+	}
+}